@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/vicxqh/srp/types"
+)
+
+// AllowDeclared is the allowlist entry that stands for the addresses of the declared services.
+const AllowDeclared = "declared"
+
+// Allowlist is the set of destinations that the server may make the agent dial. An empty allowlist
+// allows every destination.
+type Allowlist struct {
+	nets  []*net.IPNet
+	addrs map[string]bool // host:port, in canonical form
+}
+
+// NewAllowlist parses entries, each of which is a CIDR allowing any port of its hosts, a host:port, or
+// AllowDeclared for the addresses of services.
+func NewAllowlist(entries []string, services []types.Service) (*Allowlist, error) {
+	a := &Allowlist{addrs: make(map[string]bool)}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+		case entry == AllowDeclared:
+			if len(services) == 0 {
+				return nil, fmt.Errorf("allowlist entry %s requires declared services", AllowDeclared)
+			}
+			for _, svc := range services {
+				addr, err := canonicalAddr(svc.Addr)
+				if err != nil {
+					return nil, fmt.Errorf("invalid address of service %s, %v", svc.ID, err)
+				}
+				a.addrs[addr] = true
+			}
+		case strings.Contains(entry, "/"):
+			_, ipnet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowlist entry %s, %v", entry, err)
+			}
+			a.nets = append(a.nets, ipnet)
+		default:
+			addr, err := canonicalAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowlist entry %s, expected a CIDR, host:port or %s",
+					entry, AllowDeclared)
+			}
+			a.addrs[addr] = true
+		}
+	}
+	return a, nil
+}
+
+// canonicalAddr returns addr in the form it is compared in, hosts in lower case and IPs formatted alike.
+func canonicalAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return net.JoinHostPort(strings.ToLower(host), port), nil
+}
+
+// Resolve returns the address to dial for destination addr, or an error if addr is not allowed. A host
+// name allowed by a CIDR is resolved here and its IP is dialed, so that the name can not resolve to
+// another host for the dial.
+func (a *Allowlist) Resolve(ctx context.Context, addr string) (string, error) {
+	if a == nil || (len(a.nets) == 0 && len(a.addrs) == 0) {
+		return addr, nil
+	}
+	canonical, err := canonicalAddr(addr)
+	if err != nil {
+		return "", err
+	}
+	if a.addrs[canonical] {
+		return addr, nil
+	}
+	if len(a.nets) > 0 {
+		host, port, _ := net.SplitHostPort(canonical)
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else {
+			ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return "", err
+			}
+			for _, ipAddr := range ipAddrs {
+				ips = append(ips, ipAddr.IP)
+			}
+		}
+		for _, ip := range ips {
+			for _, ipnet := range a.nets {
+				if ipnet.Contains(ip) {
+					return net.JoinHostPort(ip.String(), port), nil
+				}
+			}
+		}
+	}
+	return "", refusedError{addr}
+}
+
+// refusedError is returned for a destination outside the allowlist.
+type refusedError struct {
+	addr string
+}
+
+func (e refusedError) Error() string {
+	return fmt.Sprintf("%s is not in the allowlist of the agent", e.addr)
+}
@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vicxqh/srp/types"
+)
+
+func TestAllowlist(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	a, err := NewAllowlist([]string{"10.0.0.0/8", "DB.example.com:5432", "declared"},
+		[]types.Service{{ID: "web", Addr: "[::1]:80"}})
+	require.NoError(err)
+
+	addr, err := a.Resolve(ctx, "10.1.2.3:22")
+	require.NoError(err)
+	require.Equal("10.1.2.3:22", addr)
+	addr, err = a.Resolve(ctx, "db.example.com:5432")
+	require.NoError(err)
+	require.Equal("db.example.com:5432", addr)
+	addr, err = a.Resolve(ctx, "[0:0::1]:80")
+	require.NoError(err)
+	require.Equal("[0:0::1]:80", addr)
+
+	for _, refused := range []string{"192.168.0.1:22", "172.16.0.1:5432", "[::1]:81"} {
+		_, err = a.Resolve(ctx, refused)
+		require.IsType(refusedError{}, err, refused)
+	}
+
+	// a name allowed by a CIDR is dialed by the IP it resolves to
+	a, err = NewAllowlist([]string{"127.0.0.0/8"}, nil)
+	require.NoError(err)
+	addr, err = a.Resolve(ctx, "localhost:80")
+	require.NoError(err)
+	require.Equal("127.0.0.1:80", addr)
+
+	// everything is allowed without entries
+	a, err = NewAllowlist(nil, nil)
+	require.NoError(err)
+	addr, err = a.Resolve(ctx, "192.168.0.1:22")
+	require.NoError(err)
+	require.Equal("192.168.0.1:22", addr)
+
+	for _, invalid := range []string{"10.0.0.0/33", "example.com", "declared"} {
+		_, err = NewAllowlist([]string{invalid}, nil)
+		require.Error(err, invalid)
+	}
+}
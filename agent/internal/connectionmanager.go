@@ -3,115 +3,310 @@ package internal
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/vicxqh/srp/log"
 	"github.com/vicxqh/srp/proto"
 	"github.com/vicxqh/srp/transport"
 )
 
-func ForwardToService(segment transport.Segment) error {
-	log.Debug("user(%s) -> service(%s) : %d bytes", segment.Header.User(), segment.Header.Service(),
-		segment.Header.PayloadLength())
-	sc := GetConnection(segment.Header)
+// ForwardToService forwards a segment received on session s to the service connection of its stream.
+func ForwardToService(s *session, segment transport.Segment) error {
+	header := segment.Header
+	log.Debug("stream(%d) -> service : %s %d bytes", header.Stream(), header.Type(), header.PayloadLength())
+	switch header.Type() {
+	case proto.TypeOpen:
+		if header.Network() == proto.NetworkUDP {
+			OpenDatagramConnection(s, header)
+		} else {
+			OpenConnection(s, header)
+		}
+		return nil
+	case proto.TypeData, proto.TypeWindowUpdate, proto.TypeClose, proto.TypeReset, proto.TypeDatagram:
+	default:
+		return fmt.Errorf("unexpected %s segment of stream %d", header.Type(), header.Stream())
+	}
+	if dc := getDatagramConnection(header.Stream()); dc != nil {
+		return dc.forward(segment)
+	}
+
+	sc := GetConnection(header.Stream())
 	if sc == nil {
-		return fmt.Errorf("no conneciton for user(%s):service(%s) was available",
-			segment.Header.User(), segment.Header.Service())
+		switch header.Type() {
+		case proto.TypeClose, proto.TypeReset, proto.TypeWindowUpdate:
+			// the service has gone already, the server is still granting credit or closing its side
+			return nil
+		}
+		// the server sent data before it learned that the stream is closed, make sure it does learn
+		log.Debug("no conneciton for stream %d, resetting it", header.Stream())
+		resetStream(s, header.Stream())
+		return nil
+	}
+	switch header.Type() {
+	case proto.TypeWindowUpdate:
+		increment, err := transport.WindowIncrement(segment)
+		if err != nil {
+			return err
+		}
+		sc.window.Release(int(increment))
+		return nil
+	case proto.TypeClose:
+		// a nil data tells SendLoop to half-close the service after pending data is flushed, the service may
+		// still send to the user
+		return sc.send(nil)
+	case proto.TypeReset:
+		sc.closeOnce.Do(func() {})
+		sc.cancel()
+		return nil
 	}
-	return sc.send(segment.Payload)
+	if err := sc.send(segment.Payload); err != nil {
+		sc.closeStream(proto.TypeReset)
+		sc.cancel()
+		return fmt.Errorf("failed to queue data of stream %d, %v", sc.stream, err)
+	}
+	return nil
 }
 
+// resetConnections tears down the service connections of session s, after the session ended.
+func resetConnections(s *session) {
+	connections.Range(func(key, value interface{}) bool {
+		sc := value.(*serviceConnection)
+		if sc.session == s {
+			sc.closeOnce.Do(func() {})
+			sc.cancel()
+		}
+		return true
+	})
+	datagramConnections.Range(func(key, value interface{}) bool {
+		dc := value.(*datagramConnection)
+		if dc.session == s {
+			dc.closeOnce.Do(func() {})
+			dc.cancel()
+		}
+		return true
+	})
+}
+
+// resetStream tells the server to tear down the user connection of a stream that has no service connection.
+func resetStream(s *session, stream uint32) {
+	s.Send(transport.Segment{Header: proto.NewHeader(proto.TypeReset, stream)})
+}
+
+// connections holds every service connection, keyed by stream id
 var connections sync.Map
 
+// allowlist is the set of destinations that service connections may dial
+var allowlist *Allowlist
+
 type serviceConnection struct {
-	ctx      context.Context
-	cancel   context.CancelFunc
-	user     string
-	service  string
-	conn     net.Conn
-	sendChan chan []byte
+	ctx       context.Context
+	cancel    context.CancelFunc
+	session   *session // the session that the stream belongs to
+	stream    uint32
+	user      string
+	service   string
+	conn      net.Conn
+	window    *transport.Window // credit for sending to the server
+	sendQueue *transport.Queue  // data from the server, waiting to be written to the service
+	closeOnce sync.Once         // makes sure the server is told about the end of the stream only once
+	ended     int32             // how many directions of the stream have ended, it is torn down once both have
+
+	proxyProtocol int // version of the PROXY protocol header sent to the service before anything else, 0 for none
 }
 
+// send queues data for the service, it never blocks, so a slow service can not hold up the server link.
 func (sc *serviceConnection) send(data []byte) error {
-	sc.sendChan <- data
+	return sc.sendQueue.Push(data)
+}
+
+// closeStream tells the server that the service side of the stream has ended, unless the server ended it first.
+func (sc *serviceConnection) closeStream(typ proto.Type) {
+	sc.closeOnce.Do(func() {
+		sc.session.Send(transport.Segment{Header: proto.NewHeader(typ, sc.stream)})
+	})
+}
+
+// endDirection tears down the stream once both the user and the service have closed their sides.
+func (sc *serviceConnection) endDirection() {
+	if atomic.AddInt32(&sc.ended, 1) == 2 {
+		sc.cancel()
+	}
+}
+
+// refuse tells the server that the service of the stream is not dialed, and why.
+func (sc *serviceConnection) refuse(reason string) {
+	sc.closeOnce.Do(func() {
+		sc.session.Send(transport.NewReset(sc.stream, reason))
+	})
+}
+
+// dialTimeout limits how long a stream waits for its service to accept the connection
+const dialTimeout = 10 * time.Second
+
+func (sc *serviceConnection) dial() error {
+	ctx, cancel := context.WithTimeout(sc.ctx, dialTimeout)
+	defer cancel()
+	addr, err := allowlist.Resolve(ctx, sc.service)
+	if err != nil {
+		return err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if sc.proxyProtocol != 0 {
+		// the service learns about the user before any data of the user
+		header, err := proxyHeader(sc.proxyProtocol, sc.user, conn.RemoteAddr())
+		if err == nil {
+			_, err = conn.Write(header)
+		}
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	sc.conn = conn
 	return nil
 }
 
 func (sc *serviceConnection) Serve() {
-	go sc.SendLoop()
-	go sc.RecvLoop()
+	// data arriving before the service is connected waits in sendQueue
+	if err := sc.dial(); err != nil {
+		log.Error("failed to dial to service %s, %v", sc.service, err)
+		if _, ok := err.(refusedError); ok {
+			sc.refuse(err.Error())
+		}
+		sc.closeStream(proto.TypeReset)
+		sc.cancel()
+	} else {
+		go sc.SendLoop()
+		go sc.RecvLoop()
+	}
 
 	<-sc.ctx.Done()
-	key := sc.user + "->" + sc.service
-	connections.Delete(key)
-	log.Info("removed service connection %s", key)
-	sc.conn.Close()
+	sc.closeStream(proto.TypeReset)
+	if v, ok := connections.Load(sc.stream); ok && v == sc {
+		connections.Delete(sc.stream)
+	}
+	log.Info("removed service connection %s->%s, stream %d", sc.user, sc.service, sc.stream)
+	if sc.conn != nil {
+		sc.conn.Close()
+	}
 }
 
 func (sc *serviceConnection) SendLoop() {
 	for {
-		select {
-		case <-sc.ctx.Done():
+		data, err := sc.sendQueue.Pop(sc.ctx)
+		if err != nil {
 			return
-		case data := <-sc.sendChan:
-			_, err := sc.conn.Write(data)
-			if err != nil {
-				log.Error("failed to write to service %s, %v", sc.service, err)
+		}
+		if data == nil {
+			log.Info("user %s closed the stream to service %s", sc.user, sc.service)
+			if tc, ok := sc.conn.(*net.TCPConn); ok && tc.CloseWrite() == nil {
+				sc.endDirection()
+			} else {
 				sc.cancel()
-				return
 			}
+			return
+		}
+		if _, err := sc.conn.Write(data); err != nil {
+			log.Error("failed to write to service %s, %v", sc.service, err)
+			sc.closeStream(proto.TypeReset)
+			sc.cancel()
+			return
+		}
+		if n := sc.sendQueue.Consume(len(data)); n > 0 {
+			sc.session.Send(transport.NewWindowUpdate(sc.stream, uint32(n)))
 		}
 	}
 }
 
 func (sc *serviceConnection) RecvLoop() {
+	halfClosed := false
+	defer func() {
+		if halfClosed {
+			// the service may still read what the user sends
+			sc.endDirection()
+		} else {
+			sc.cancel()
+		}
+	}()
 	for {
 		select {
 		case <-sc.ctx.Done():
 			return
 		default:
-			buffer := make([]byte, 1024)
+			// never read more than the server is able to take
+			credit, err := sc.window.Acquire(sc.ctx, 1024)
+			if err != nil {
+				return
+			}
+			buffer := make([]byte, credit)
 			n, err := sc.conn.Read(buffer)
+			sc.window.Release(credit - n)
+			if err == io.EOF {
+				log.Info("service %s closed the connection of user %s", sc.service, sc.user)
+				sc.closeStream(proto.TypeClose)
+				halfClosed = true
+				return
+			}
+			if err != nil && sc.ctx.Err() != nil {
+				// closed by this side
+				return
+			}
 			if err != nil {
 				log.Error("failed to read from service %s, %v", sc.service, err)
-				sc.cancel()
+				sc.closeStream(proto.TypeReset)
 				return
 			}
 			data := buffer[:n]
 			log.Debug("received %d bytes from service %s", len(data), sc.service)
-			header, _ := proto.NewHeader(sc.user, sc.service)
+			header := proto.NewHeader(proto.TypeData, sc.stream)
 			header.SetPayloadLength(uint32(len(data)))
-			SendToServer(transport.Segment{header, data})
+			if err := sc.session.Send(transport.Segment{Header: header, Payload: data}); err != nil {
+				return
+			}
 		}
 	}
 }
 
-func GetConnection(header proto.Header) *serviceConnection {
-	key := header.User() + "->" + header.Service()
-	var sc *serviceConnection
-	scv, ok := connections.Load(key)
-	if ok {
-		sc = scv.(*serviceConnection)
-	} else {
-		log.Info("creating new connection for %s", key)
-		conn, err := net.Dial("tcp", header.Service())
-		if err != nil {
-			log.Error("failed to dial to service %s, %v", header.Service(), err)
-			return nil
-		}
-		ctx, cancel := context.WithCancel(context.Background())
-		sc = &serviceConnection{
-			user:     header.User(),
-			service:  header.Service(),
-			conn:     conn,
-			ctx:      ctx,
-			cancel:   cancel,
-			sendChan: make(chan []byte, 1),
-		}
+func GetConnection(stream uint32) *serviceConnection {
+	scv, ok := connections.Load(stream)
+	if !ok {
+		return nil
+	}
+	return scv.(*serviceConnection)
+}
+
+// OpenConnection creates the service connection of a new user stream announced by an OPEN segment on
+// session s. The service is dialed in the background, so that a slow service never holds up the server link.
+func OpenConnection(s *session, header proto.Header) *serviceConnection {
+	if old := GetConnection(header.Stream()); old != nil {
+		log.Warn("stream %d is reopened, dropping the stale connection", header.Stream())
+		old.closeOnce.Do(func() {})
+		old.cancel()
+	}
+	log.Info("creating new connection for %s->%s, stream %d", header.User(), header.Service(), header.Stream())
+	ctx, cancel := context.WithCancel(context.Background())
+	sc := &serviceConnection{
+		session:   s,
+		stream:    header.Stream(),
+		user:      header.User(),
+		service:   header.Service(),
+		ctx:       ctx,
+		cancel:    cancel,
+		window:    transport.NewWindow(proto.InitialWindowSize),
+		sendQueue: transport.NewQueue(proto.InitialWindowSize),
 
-		go sc.Serve()
-		connections.Store(key, sc)
+		proxyProtocol: header.ProxyProtocol(),
 	}
+
+	connections.Store(sc.stream, sc)
+	go sc.Serve()
 	return sc
 }
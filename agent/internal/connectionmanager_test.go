@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vicxqh/srp/log"
+	"github.com/vicxqh/srp/proto"
+	"github.com/vicxqh/srp/transport"
+)
+
+func TestHalfClose(t *testing.T) {
+	require := require.New(t)
+	// the log is not set up in tests
+	log.SetLevel(log.LevelFatal)
+
+	// a service answering once the whole request is read
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer service.Close()
+	requests := make(chan string, 1)
+	go func() {
+		conn, err := service.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := ioutil.ReadAll(conn)
+		requests <- string(request)
+		conn.Write([]byte("response"))
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &session{ctx: ctx, cancel: cancel, sendChan: make(chan transport.Segment, 1)}
+	open, err := proto.NewOpenHeader(11, "192.0.2.1:5555", service.Addr().String())
+	require.NoError(err)
+	require.NoError(ForwardToService(s, transport.Segment{Header: open}))
+	header := proto.NewHeader(proto.TypeData, 11)
+	header.SetPayloadLength(7)
+	require.NoError(ForwardToService(s, transport.Segment{Header: header, Payload: []byte("request")}))
+	require.NoError(ForwardToService(s, transport.Segment{Header: proto.NewHeader(proto.TypeClose, 11)}))
+
+	receive := func() transport.Segment {
+		select {
+		case segment := <-s.sendChan:
+			return segment
+		case <-time.After(time.Second):
+			require.Fail("nothing is sent to the server")
+		}
+		return transport.Segment{}
+	}
+	// the service learns that the request is complete, and still answers it
+	require.Equal("request", <-requests)
+	response := receive()
+	require.Equal(proto.TypeData, response.Header.Type())
+	require.Equal("response", string(response.Payload))
+	require.Equal(proto.TypeClose, receive().Header.Type())
+
+	// the stream ends once both sides are closed, the server is not reset
+	require.Eventually(func() bool {
+		return GetConnection(11) == nil
+	}, time.Second, 10*time.Millisecond)
+	require.Empty(s.sendChan)
+}
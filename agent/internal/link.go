@@ -2,110 +2,404 @@ package internal
 
 import (
 	"context"
-	"encoding/json"
+	gotls "crypto/tls"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/vicxqh/srp/proto"
 	"github.com/vicxqh/srp/transport"
 	"github.com/vicxqh/srp/transport/plain"
+	"github.com/vicxqh/srp/transport/tls"
 
 	"github.com/vicxqh/srp/log"
 	"github.com/vicxqh/srp/types"
 )
 
-func ConnectToServer(server, myName, description string) {
+type Config struct {
+	Server      string // address of the http service of server
+	Name        string
+	Description string
+	// Token authenticates the agent, if the server issued one for Name
+	Token string
+
+	// Transport is how the data connection is carried, transport.Plain or transport.TLS
+	Transport string
+	// TLSCA is the CA bundle used to verify the server, system CAs are used if it is empty
+	TLSCA string
+	// TLSServerName is the name expected in the server certificate, the host of Server by default
+	TLSServerName string
+	// TLSCert and TLSKey are the client certificate presented to servers that require one
+	TLSCert string
+	TLSKey  string
+
+	// HeartbeatInterval is how often the server is pinged, 0 disables heartbeats. The link is dropped and
+	// set up again if the server stays silent for longer than HeartbeatTimeout.
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+
+	// RetryInterval is the wait after the first failed attempt to connect, it is doubled after every
+	// further failure up to MaxRetryInterval.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	// MaxRetries is how many times a failed attempt is retried before giving up, 0 retries forever.
+	// Rejections that retrying does not fix, like an invalid token, are never retried.
+	MaxRetries int
+
+	// Connections is how many data connections are opened in parallel, streams are spread over them.
+	Connections int
+
+	// Services are declared to the server, which lists them ready to be exposed by the agent
+	Services []types.Service
+	// Allow is the allowlist of destinations that the server may make the agent dial, see NewAllowlist.
+	// Every destination is allowed if it is empty.
+	Allow []string
+}
+
+func ConnectToServer(config Config) error {
 	req := types.AgentRegistrationRequest{
-		ID:          myName,
-		Description: description,
+		Agent: types.Agent{
+			ID:          config.Name,
+			Description: config.Description,
+		},
+		Token:        config.Token,
+		Version:      proto.Version,
+		Capabilities: proto.Capabilities,
+		Services:     config.Services,
 	}
-	retrying := false
-	for {
-		if retrying {
-			time.Sleep(time.Second)
+	server := config.Server
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return fmt.Errorf("invalid server address %s, %v", server, err)
+	}
+	var tlsConfig *gotls.Config
+	switch config.Transport {
+	case transport.Plain:
+	case transport.TLS:
+		serverName := config.TLSServerName
+		if serverName == "" {
+			serverName = host
+		}
+		if tlsConfig, err = tls.ClientConfig(config.TLSCA, serverName, config.TLSCert, config.TLSKey); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown transport %s", config.Transport)
+	}
+	if config.HeartbeatInterval > 0 && config.HeartbeatTimeout <= config.HeartbeatInterval {
+		return fmt.Errorf("heartbeat timeout %v must be longer than the interval %v", config.HeartbeatTimeout,
+			config.HeartbeatInterval)
+	}
+	if config.RetryInterval <= 0 || config.MaxRetryInterval < config.RetryInterval {
+		return fmt.Errorf("invalid retry intervals %v to %v", config.RetryInterval, config.MaxRetryInterval)
+	}
+	if config.Connections < 1 {
+		return fmt.Errorf("at least 1 connection is required, got %d", config.Connections)
+	}
+	if allowlist, err = NewAllowlist(config.Allow, config.Services); err != nil {
+		return err
+	}
+
+	// the first connection registers the agent, the others join its pool. The agent keeps running as long
+	// as the first one does.
+	errs := make(chan error, 1)
+	go func() {
+		errs <- stayConnected(config, req, host, tlsConfig, 0)
+	}()
+	if config.Connections > 1 {
+		select {
+		case <-registered:
+		case err := <-errs:
+			return err
+		}
+		if currentPool() == "" {
+			log.Warn("server does not pool connections of an agent, using a single connection")
 		} else {
-			retrying = true
+			for i := 1; i < config.Connections; i++ {
+				go func(index int) {
+					if err := stayConnected(config, req, host, tlsConfig, index); err != nil {
+						log.Error("closing connection %d of the pool, %v", index, err)
+					}
+				}(i)
+			}
 		}
-		rsp, err := http.Get(fmt.Sprintf("http://%s/api/v1/dataport", server))
-		if err != nil {
-			log.Error("failed to get data port, %v", err)
-			continue
+	}
+	return <-errs
+}
+
+// stayConnected keeps connection index of the pool connected to the server, until it is rejected for
+// good or retries are used up.
+func stayConnected(config Config, req types.AgentRegistrationRequest, host string, tlsConfig *gotls.Config,
+	index int) error {
+	failures := 0
+	for {
+		if failures > 0 {
+			delay := backoff(config.RetryInterval, config.MaxRetryInterval, failures)
+			log.Info("retrying in %v ...", delay.Round(time.Millisecond))
+			time.Sleep(delay)
 		}
-		body, _ := ioutil.ReadAll(rsp.Body)
-		rsp.Body.Close()
-		if rsp.StatusCode != http.StatusOK {
-			log.Error("failed to get data port, http status %d, body: %s", rsp.StatusCode, string(body))
+		err := connect(config, req, host, tlsConfig, index)
+		if err == nil {
+			// the link was up and dropped, set it up again right away
+			failures = 0
 			continue
 		}
-		ss := strings.Split(server, ":")
-		dataServer := ss[0] + ":" + string(body)
-		log.Info("connecting to data server %s ...", dataServer)
-		conn, err := net.Dial("tcp", dataServer)
-		if err != nil {
-			log.Error("failed to connect to data server %s, %v", dataServer, err)
-			continue
+		if perr, ok := err.(permanentError); ok {
+			return fmt.Errorf("server rejected connection %d of the agent, %v", index, perr.error)
+		}
+		failures++
+		if config.MaxRetries > 0 && failures > config.MaxRetries {
+			return fmt.Errorf("giving up after %d failed attempts, %v", failures, err)
 		}
+	}
+}
 
-		ctx, cancel := context.WithCancel(context.Background())
-		sc = &serverConnection{
-			rawConn:  conn,
-			req:      req,
-			ctx:      ctx,
-			cancel:   cancel,
-			sendChan: make(chan transport.Segment, 1),
+// permanentError is a failure that retrying does not fix.
+type permanentError struct {
+	error
+}
+
+// backoff returns how long to wait after failures consecutive failed attempts. The wait is doubled for
+// every failure up to max, and randomized so that agents which lost the server at the same time do not
+// come back at the same time.
+func backoff(initial, max time.Duration, failures int) time.Duration {
+	d := initial
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	randomMu.Lock()
+	defer randomMu.Unlock()
+	return d/2 + time.Duration(random.Int63n(int64(d/2)+1))
+}
+
+// random is seeded unlike the default source, so that agents do not wait alike. It is shared by the links
+// of the pool, and guarded by randomMu.
+var (
+	randomMu sync.Mutex
+	random   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// connect sets up a link for connection index and serves it until it drops. It returns nil if the link was
+// registered, so that it is set up again right away.
+func connect(config Config, req types.AgentRegistrationRequest, host string, tlsConfig *gotls.Config,
+	index int) error {
+	client := http.Client{Timeout: handshakeTimeout}
+	rsp, err := client.Get(fmt.Sprintf("http://%s/api/v1/dataport", config.Server))
+	if err != nil {
+		log.Error("failed to get data port, %v", err)
+		return err
+	}
+	body, _ := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		log.Error("failed to get data port, http status %d, body: %s", rsp.StatusCode, string(body))
+		return fmt.Errorf("http status %d", rsp.StatusCode)
+	}
+	dataServer := net.JoinHostPort(host, string(body))
+	log.Info("connecting to data server %s ...", dataServer)
+	conn, err := net.DialTimeout("tcp", dataServer, handshakeTimeout)
+	if err != nil {
+		log.Error("failed to connect to data server %s, %v", dataServer, err)
+		return err
+	}
+
+	var t transport.Transport
+	if tlsConfig != nil {
+		tc := tls.Client(conn, tlsConfig)
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		err = tc.Handshake()
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			log.Error("tls handshake with %s failed, %v", dataServer, err)
+			conn.Close()
+			return err
 		}
-		sc.Serve()
+		t = tc
+	} else {
+		t = plain.NewConnection(conn)
 	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sc := &serverConnection{
+		index:  index,
+		conn:   t,
+		req:    req,
+		ctx:    ctx,
+		cancel: cancel,
+		heartbeat: &transport.Heartbeat{
+			Interval: config.HeartbeatInterval,
+			Timeout:  config.HeartbeatTimeout,
+		},
+		control: make(chan transport.Segment, transport.ControlQueueSize),
+	}
+	return sc.Serve()
 }
 
-type serverConnection struct {
-	rawConn  net.Conn
-	conn     transport.Transport
-	req      types.AgentRegistrationRequest
-	ctx      context.Context
+// session outlives the link it is carried on, so that streams survive a dropped link if the server
+// resumes the session on the next one.
+type session struct {
+	*transport.Session
+	ctx      context.Context // done when the session ends
 	cancel   context.CancelFunc
 	sendChan chan transport.Segment
+	sendMu   sync.Mutex // held by the SendLoop of the current link
+}
+
+var (
+	sessionMu sync.Mutex
+	// sessions holds the current session of every connection of the pool, keyed by index
+	sessions = make(map[int]*session)
+	// pool identifies the pool of connections to the server, empty if the server does not pool them
+	pool string
+	// registered is closed once the agent is registered by its first connection
+	registered     = make(chan struct{})
+	registeredOnce sync.Once
+)
+
+func currentSession(index int) *session {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	return sessions[index]
+}
+
+func currentPool() string {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	return pool
+}
+
+// startSession makes a new session current for connection index, streams of the old one are torn down.
+func startSession(index int, ts *transport.Session) *session {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &session{
+		Session:  ts,
+		ctx:      ctx,
+		cancel:   cancel,
+		sendChan: make(chan transport.Segment, 1),
+	}
+	sessionMu.Lock()
+	old := sessions[index]
+	sessions[index] = s
+	sessionMu.Unlock()
+	if old != nil {
+		old.end()
+	}
+	return s
 }
 
-var sc *serverConnection
+// end ends the session, its streams are torn down.
+func (s *session) end() {
+	s.cancel()
+	resetConnections(s)
+}
+
+func (s *session) Send(segment transport.Segment) error {
+	select {
+	case s.sendChan <- segment:
+		return nil
+	case <-s.ctx.Done():
+		return errors.New("session has ended")
+	}
+}
+
+// serverConnection is a link to the server, carrying the current session of a connection of the pool.
+type serverConnection struct {
+	index int // of the connection in the pool
+	conn  transport.Transport
+	req   types.AgentRegistrationRequest
+	// capabilities are the optional features agreed with the server
+	capabilities []string
+	session      *session
+	ctx          context.Context
+	cancel       context.CancelFunc
+	heartbeat    *transport.Heartbeat
+	control      chan transport.Segment // link segments, sent ahead of the segments of the session
+
+	mu     sync.Mutex
+	closed bool // nothing received on the link counts once it is closed
+}
+
+// handshakeTimeout limits how long the tls handshake and the registration may take
+const handshakeTimeout = 10 * time.Second
 
 func (sc *serverConnection) handshake() error {
 	log.Info("handshaking ...")
-	data, _ := json.Marshal(sc.req)
-	if _, err := sc.rawConn.Write(data); err != nil {
-		log.Error("failed to write to server, %v", err)
-		return err
+	conn := sc.conn.Conn()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	req := sc.req
+	cur := currentSession(sc.index)
+	if cur != nil && cur.ID != "" {
+		req.Session = cur.ID
+		req.Received = cur.ReceivedCount()
 	}
-	buffer := make([]byte, 1024)
-	n, err := sc.rawConn.Read(buffer)
-	if err != nil {
-		log.Error("failed to read registration response, %v", err)
+	req.Pool = currentPool()
+	req.Join = sc.index > 0
+	if err := transport.SendHandshake(sc.conn, req); err != nil {
+		log.Error("failed to write to server, %v", err)
 		return err
 	}
-	buffer = buffer[:n]
-	log.Info("server response: %s", string(buffer))
-
 	var regRsp types.AgentRegistrationResponse
-	if err := json.Unmarshal(buffer, &regRsp); err != nil {
-		log.Error("failed to unmarshal handshake data %s, %v", string(buffer), err)
+	if err := transport.ReceiveHandshake(sc.conn, &regRsp); err != nil {
+		log.Error("failed to read registration response, the server may be of an older version, %v", err)
 		return err
 	}
+	log.Info("server response: succeeded %v, message %s, version %d, capabilities %v, resumed %v",
+		regRsp.Succeeded, regRsp.Message, regRsp.Version, regRsp.Capabilities, regRsp.Resumed)
 	if !regRsp.Succeeded {
 		log.Error("server returned failure, %s", regRsp.Message)
+		if regRsp.Permanent {
+			return permanentError{errors.New(regRsp.Message)}
+		}
 		return errors.New(regRsp.Message)
 	}
+	if regRsp.Version < proto.MinVersion || regRsp.Version > proto.Version {
+		return permanentError{fmt.Errorf("server chose protocol version %d, agent speaks %d to %d",
+			regRsp.Version, proto.MinVersion, proto.Version)}
+	}
+	sc.capabilities = regRsp.Capabilities
+	if regRsp.AgentID != "" && regRsp.AgentID != req.ID {
+		log.Warn("another agent named %s is connected, registered as %s", req.ID, regRsp.AgentID)
+	}
+	if sc.index == 0 {
+		sessionMu.Lock()
+		pool = regRsp.Pool
+		sessionMu.Unlock()
+		registeredOnce.Do(func() { close(registered) })
+	}
 
-	sc.conn = plain.NewConnection(sc.rawConn)
+	if regRsp.Resumed && cur != nil && regRsp.Session == cur.ID {
+		if err := cur.Ack(regRsp.Received); err != nil {
+			cur.end()
+			return fmt.Errorf("session is broken, %v", err)
+		}
+		log.Info("resumed the session, %d segments received by server", regRsp.Received)
+		sc.session = cur
+		return nil
+	}
+	if cur != nil && cur.ID != "" {
+		log.Info("the session is not resumed, dropping its connections")
+	}
+	sc.session = startSession(sc.index, &transport.Session{ID: regRsp.Session})
 	return nil
 }
 
+// Stop drops the link. Segments it is still sending are replayed on the next link if the session is resumed.
 func (sc *serverConnection) Stop() {
 	sc.cancel()
-	sc.rawConn.Close()
+	// closing the transport connection lets tls tell the server with a close_notify
+	sc.conn.Conn().Close()
+	sc.mu.Lock()
+	sc.closed = true
+	sc.mu.Unlock()
 }
 
 func (sc *serverConnection) Serve() error {
@@ -116,45 +410,137 @@ func (sc *serverConnection) Serve() error {
 	}
 	go sc.SendLoop()
 	go sc.RecvLoop()
+	if sc.heartbeat.Interval > 0 && proto.HasCapability(sc.capabilities, proto.CapHeartbeat) {
+		go sc.keepAlive()
+	}
 	<-sc.ctx.Done()
-	return sc.ctx.Err()
+	sc.Stop()
+	if sc.session.ID == "" {
+		// the server can not resume the session on another link
+		sc.session.end()
+	}
+	return nil
+}
+
+// sendControl queues a segment that is meaningful on this link only. It never blocks, so that RecvLoop is
+// not held up by a SendLoop writing to a busy link. The segment is dropped if the queue is full, the
+// segments sent instead prove that the link is alive, and a later ACK covers the segments of a dropped one.
+func (sc *serverConnection) sendControl(segment transport.Segment) error {
+	if sc.ctx.Err() != nil {
+		return errors.New("link to server has dropped")
+	}
+	select {
+	case sc.control <- segment:
+	default:
+		log.Debug("dropped a %s segment, the link falls behind", segment.Header.Type())
+	}
+	return nil
+}
+
+// keepAlive drops the link once it is found dead, so that a new one is set up.
+func (sc *serverConnection) keepAlive() {
+	err := sc.heartbeat.Run(sc.ctx, func() error {
+		return sc.sendControl(transport.NewPing())
+	})
+	if err != nil {
+		log.Error("link to server is dead, %v", err)
+		sc.cancel()
+	}
 }
 
 func (sc *serverConnection) SendLoop() {
+	s := sc.session
+	// the previous link must be done with sending before segments it missed are replayed
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if sc.ctx.Err() != nil {
+		return
+	}
+	send := func(data transport.Segment) bool {
+		log.Debug("stream(%d) -> server : %s %d bytes", data.Header.Stream(), data.Header.Type(),
+			data.Header.PayloadLength())
+		if err := sc.conn.Send(data); err != nil {
+			log.Error("failed to send to server, %v", err)
+			sc.cancel()
+			return false
+		}
+		return true
+	}
+	for _, data := range s.Unacked() {
+		if !send(data) {
+			return
+		}
+	}
 	for {
+		// link segments go first, a PONG must not wait behind a window of data
+		select {
+		case data := <-sc.control:
+			if !send(data) {
+				return
+			}
+			continue
+		default:
+		}
 		select {
 		case <-sc.ctx.Done():
 			return
-		case data := <-sc.sendChan:
-			log.Debug("service(%s) -> user(%s) : %d bytes", data.Header.Service(), data.Header.User(),
-				data.Header.PayloadLength())
-			if err := sc.conn.Send(data); err != nil {
-				log.Error("failed to send to server, %v", err)
-				sc.cancel()
+		case data := <-sc.control:
+			if !send(data) {
+				return
+			}
+		case data := <-s.sendChan:
+			s.Sent(data)
+			if !send(data) {
 				return
 			}
 		}
 	}
 }
 
-func SendToServer(segment transport.Segment) error {
-	sc.sendChan <- segment
-	return nil
-}
-
 func (sc *serverConnection) RecvLoop() {
+	s := sc.session
 	for {
-		select {
-		case <-sc.ctx.Done():
+		data, err := sc.conn.Receive()
+		if err != nil {
+			if sc.ctx.Err() == nil {
+				log.Error("failed to receive from server, %v", err)
+			}
+			sc.cancel()
 			return
-		default:
-			data, err := sc.conn.Receive()
+		}
+		sc.mu.Lock()
+		if sc.closed {
+			// the server replays the segment if the session is resumed
+			sc.mu.Unlock()
+			return
+		}
+		received := s.Received(data)
+		sc.mu.Unlock()
+
+		sc.heartbeat.Seen()
+		switch data.Header.Type() {
+		case proto.TypePing:
+			sc.sendControl(transport.NewPong())
+			continue
+		case proto.TypePong:
+			continue
+		case proto.TypeAck:
+			n, err := transport.AckCount(data)
+			if err == nil {
+				err = s.Ack(n)
+			}
 			if err != nil {
-				log.Error("failed to receive from server, %v", err)
+				log.Error("bad ack from server, %v", err)
 				sc.cancel()
 				return
 			}
-			ForwardToService(data)
+			continue
+		}
+		if s.ID != "" && received%transport.AckEvery == 0 {
+			sc.sendControl(transport.NewAck(received))
+		}
+		if err := ForwardToService(s, data); err != nil {
+			log.Error("failed to forward to service, %v", err)
 		}
 	}
 }
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff(t *testing.T) {
+	require := require.New(t)
+
+	for i := 0; i < 100; i++ {
+		d := backoff(time.Second, time.Minute, 1)
+		require.True(d >= time.Second/2 && d <= time.Second, d)
+
+		d = backoff(time.Second, time.Minute, 4)
+		require.True(d >= 4*time.Second && d <= 8*time.Second, d)
+
+		d = backoff(time.Second, time.Minute, 100)
+		require.True(d >= 30*time.Second && d <= time.Minute, d)
+	}
+
+	// the links of a pool back off at the same time
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				backoff(time.Second, time.Minute, j)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader returns the PROXY protocol header of version, which tells a service that the connection
+// from the agent at dst is on behalf of user. A user that is not an ip address is told as unknown.
+func proxyHeader(version int, user string, dst net.Addr) ([]byte, error) {
+	if version != 1 && version != 2 {
+		return nil, fmt.Errorf("unknown PROXY protocol version %d", version)
+	}
+	srcIP, srcPort, srcOK := splitIPPort(user)
+	dstIP, dstPort, dstOK := splitIPPort(dst.String())
+	known := srcOK && dstOK
+	ipv4 := known && srcIP.To4() != nil && dstIP.To4() != nil
+	if known && !ipv4 {
+		// both addresses must be of the same family, ipv4 ones are mapped to ipv6
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+
+	if version == 1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		if ipv4 {
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, srcPort, dstPort)), nil
+		}
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(srcIP), ipv6String(dstIP), srcPort,
+			dstPort)), nil
+	}
+
+	header := append([]byte(nil), proxyV2Signature...)
+	if !known {
+		// LOCAL command, the service uses the address of the agent
+		return append(header, 0x20, 0x00, 0, 0), nil
+	}
+	family := byte(0x21) // tcp over ipv6
+	if ipv4 {
+		family = 0x11 // tcp over ipv4
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	}
+	var addrs []byte
+	addrs = append(addrs, srcIP...)
+	addrs = append(addrs, dstIP...)
+	addrs = append(addrs, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+	header = append(header, 0x21, family, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(addrs)))
+	return append(header, addrs...), nil
+}
+
+// ipv6String formats ip as an ipv6 address, net.IP prints ipv4-mapped addresses as ipv4 ones.
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// splitIPPort parses addr as ip:port, the zone of an ipv6 address is dropped.
+func splitIPPort(addr string) (net.IP, int, bool) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, false
+	}
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(p)
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, 0, false
+	}
+	return ip, port, true
+}
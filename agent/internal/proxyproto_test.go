@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyHeader(t *testing.T) {
+	require := require.New(t)
+	dst4 := &net.TCPAddr{IP: net.ParseIP("10.0.0.80"), Port: 80}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("fd00::80"), Port: 443}
+
+	header, err := proxyHeader(1, "192.0.2.1:5555", dst4)
+	require.NoError(err)
+	require.Equal("PROXY TCP4 192.0.2.1 10.0.0.80 5555 80\r\n", string(header))
+	header, err = proxyHeader(1, "[fe80::1%eth0]:5555", dst6)
+	require.NoError(err)
+	require.Equal("PROXY TCP6 fe80::1 fd00::80 5555 443\r\n", string(header))
+	// addresses of different families are told as ipv6
+	header, err = proxyHeader(1, "192.0.2.1:5555", dst6)
+	require.NoError(err)
+	require.Equal("PROXY TCP6 ::ffff:192.0.2.1 fd00::80 5555 443\r\n", string(header))
+	header, err = proxyHeader(1, "user.example.com:5555", dst4)
+	require.NoError(err)
+	require.Equal("PROXY UNKNOWN\r\n", string(header))
+
+	header, err = proxyHeader(2, "192.0.2.1:5555", dst4)
+	require.NoError(err)
+	require.Equal(append([]byte("\r\n\r\n\x00\r\nQUIT\n"),
+		0x21, 0x11, 0, 12,
+		192, 0, 2, 1,
+		10, 0, 0, 80,
+		0x15, 0xb3, 0, 80), header)
+	header, err = proxyHeader(2, "[2001:db8::1]:5555", dst6)
+	require.NoError(err)
+	require.Equal(16+36, len(header))
+	require.Equal([]byte{0x21, 0x21, 0, 36}, header[12:16])
+	require.Equal(net.ParseIP("2001:db8::1").To16(), net.IP(header[16:32]))
+	require.Equal(net.ParseIP("fd00::80").To16(), net.IP(header[32:48]))
+	require.Equal([]byte{0x15, 0xb3, 0x01, 0xbb}, header[48:52])
+	header, err = proxyHeader(2, "user.example.com:5555", dst4)
+	require.NoError(err)
+	require.Equal(append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20, 0x00, 0, 0), header)
+
+	_, err = proxyHeader(3, "192.0.2.1:5555", dst4)
+	require.Error(err)
+}
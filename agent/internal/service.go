@@ -0,0 +1,28 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/vicxqh/srp/types"
+)
+
+// LoadServices reads the services offered by the agent from a json file, which holds a list of services
+// with ID, Addr and optionally Description.
+func LoadServices(path string) ([]types.Service, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var services []types.Service
+	if err := json.Unmarshal(data, &services); err != nil {
+		return nil, fmt.Errorf("invalid services file %s, %v", path, err)
+	}
+	for _, svc := range services {
+		if svc.ID == "" || svc.Addr == "" {
+			return nil, fmt.Errorf("service %q in %s needs an ID and an Addr", svc.ID, path)
+		}
+	}
+	return services, nil
+}
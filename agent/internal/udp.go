@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/vicxqh/srp/log"
+	"github.com/vicxqh/srp/proto"
+	"github.com/vicxqh/srp/transport"
+)
+
+// datagramConnections holds every udp connection to a service, keyed by stream id
+var datagramConnections sync.Map
+
+// maxDatagramSize is the size of the largest udp payload
+const maxDatagramSize = 65535
+
+// maxPendingDatagrams is how many datagrams may wait for the service to be dialed, more are dropped
+const maxPendingDatagrams = 64
+
+// datagramConnection forwards the datagrams of a udp stream between the server and a service. The server
+// ends the stream once it is idle.
+type datagramConnection struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	session   *session // the session that the stream belongs to
+	stream    uint32
+	user      string
+	service   string
+	conn      net.Conn
+	closeOnce sync.Once // makes sure the server is told about the end of the stream only once
+
+	mu      sync.Mutex
+	dialed  bool
+	pending [][]byte // datagrams from the server, waiting for the service to be dialed
+}
+
+func getDatagramConnection(stream uint32) *datagramConnection {
+	v, ok := datagramConnections.Load(stream)
+	if !ok {
+		return nil
+	}
+	return v.(*datagramConnection)
+}
+
+// OpenDatagramConnection creates the udp connection of a new stream announced by an OPEN segment on
+// session s.
+func OpenDatagramConnection(s *session, header proto.Header) *datagramConnection {
+	if old := getDatagramConnection(header.Stream()); old != nil {
+		log.Warn("stream %d is reopened, dropping the stale connection", header.Stream())
+		old.closeOnce.Do(func() {})
+		old.cancel()
+	}
+	log.Info("creating new udp connection for %s->%s, stream %d", header.User(), header.Service(), header.Stream())
+	ctx, cancel := context.WithCancel(context.Background())
+	dc := &datagramConnection{
+		ctx:     ctx,
+		cancel:  cancel,
+		session: s,
+		stream:  header.Stream(),
+		user:    header.User(),
+		service: header.Service(),
+	}
+	datagramConnections.Store(dc.stream, dc)
+	go dc.Serve()
+	return dc
+}
+
+// forward handles a segment of the stream received from the server.
+func (dc *datagramConnection) forward(segment transport.Segment) error {
+	switch segment.Header.Type() {
+	case proto.TypeDatagram:
+		dc.mu.Lock()
+		if !dc.dialed {
+			if len(dc.pending) < maxPendingDatagrams {
+				dc.pending = append(dc.pending, segment.Payload)
+			}
+			dc.mu.Unlock()
+			return nil
+		}
+		dc.mu.Unlock()
+		dc.write(segment.Payload)
+		return nil
+	case proto.TypeClose, proto.TypeReset:
+		dc.closeOnce.Do(func() {})
+		dc.cancel()
+		return nil
+	case proto.TypeWindowUpdate:
+		// datagrams are not flow controlled
+		return nil
+	}
+	return fmt.Errorf("unexpected %s segment of udp stream %d", segment.Header.Type(), dc.stream)
+}
+
+func (dc *datagramConnection) write(datagram []byte) {
+	if _, err := dc.conn.Write(datagram); err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+		log.Warn("failed to write to udp service %s, %v", dc.service, err)
+	}
+}
+
+// closeStream tells the server that the udp connection is gone, unless the server ended the stream first.
+func (dc *datagramConnection) closeStream(typ proto.Type) {
+	dc.closeOnce.Do(func() {
+		dc.session.Send(transport.Segment{Header: proto.NewHeader(typ, dc.stream)})
+	})
+}
+
+// refuse tells the server that the service of the stream is not dialed, and why.
+func (dc *datagramConnection) refuse(reason string) {
+	dc.closeOnce.Do(func() {
+		dc.session.Send(transport.NewReset(dc.stream, reason))
+	})
+}
+
+func (dc *datagramConnection) dial() error {
+	ctx, cancel := context.WithTimeout(dc.ctx, dialTimeout)
+	defer cancel()
+	addr, err := allowlist.Resolve(ctx, dc.service)
+	if err != nil {
+		return err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return err
+	}
+	dc.conn = conn
+	return nil
+}
+
+func (dc *datagramConnection) Serve() {
+	if err := dc.dial(); err != nil {
+		log.Error("failed to dial to udp service %s, %v", dc.service, err)
+		if _, ok := err.(refusedError); ok {
+			dc.refuse(err.Error())
+		}
+		dc.closeStream(proto.TypeReset)
+		dc.cancel()
+	} else {
+		dc.mu.Lock()
+		for _, datagram := range dc.pending {
+			dc.write(datagram)
+		}
+		dc.pending = nil
+		dc.dialed = true
+		dc.mu.Unlock()
+		go dc.RecvLoop()
+	}
+
+	<-dc.ctx.Done()
+	dc.closeStream(proto.TypeReset)
+	if v, ok := datagramConnections.Load(dc.stream); ok && v == dc {
+		datagramConnections.Delete(dc.stream)
+	}
+	log.Info("removed udp connection %s->%s, stream %d", dc.user, dc.service, dc.stream)
+	if dc.conn != nil {
+		dc.conn.Close()
+	}
+}
+
+// RecvLoop sends each datagram from the service to the server.
+func (dc *datagramConnection) RecvLoop() {
+	defer dc.cancel()
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, err := dc.conn.Read(buffer)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			// an earlier datagram found no service listening, later ones may
+			continue
+		}
+		if err != nil {
+			if dc.ctx.Err() == nil {
+				log.Error("failed to read from udp service %s, %v", dc.service, err)
+				dc.closeStream(proto.TypeReset)
+			}
+			return
+		}
+		header := proto.NewHeader(proto.TypeDatagram, dc.stream)
+		header.SetPayloadLength(uint32(n))
+		datagram := append([]byte(nil), buffer[:n]...)
+		if err := dc.session.Send(transport.Segment{Header: header, Payload: datagram}); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vicxqh/srp/log"
+	"github.com/vicxqh/srp/proto"
+	"github.com/vicxqh/srp/transport"
+)
+
+func TestDatagramConnection(t *testing.T) {
+	require := require.New(t)
+	// the log is not set up in tests
+	log.SetLevel(log.LevelFatal)
+
+	// a service echoing datagrams
+	service, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	defer service.Close()
+	go func() {
+		buffer := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := service.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			service.WriteTo(buffer[:n], addr)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &session{ctx: ctx, cancel: cancel, sendChan: make(chan transport.Segment, 1)}
+	open, err := proto.NewOpenHeader(9, "192.0.2.1:5353", service.LocalAddr().String())
+	require.NoError(err)
+	open.SetNetwork(proto.NetworkUDP)
+	require.NoError(ForwardToService(s, transport.Segment{Header: open}))
+
+	// datagrams arriving before the service is dialed are not lost, nor merged
+	for _, payload := range []string{"one", "two"} {
+		header := proto.NewHeader(proto.TypeDatagram, 9)
+		header.SetPayloadLength(uint32(len(payload)))
+		require.NoError(ForwardToService(s, transport.Segment{Header: header, Payload: []byte(payload)}))
+	}
+	for _, payload := range []string{"one", "two"} {
+		select {
+		case echo := <-s.sendChan:
+			require.Equal(proto.TypeDatagram, echo.Header.Type())
+			require.Equal(uint32(9), echo.Header.Stream())
+			require.Equal(payload, string(echo.Payload))
+		case <-time.After(time.Second):
+			require.Fail("no echo from service")
+		}
+	}
+
+	require.NoError(ForwardToService(s, transport.Segment{Header: proto.NewHeader(proto.TypeClose, 9)}))
+	require.Eventually(func() bool {
+		return getDatagramConnection(9) == nil
+	}, time.Second, 10*time.Millisecond)
+}
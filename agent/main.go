@@ -3,8 +3,11 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/vicxqh/srp/agent/internal"
+	"github.com/vicxqh/srp/transport"
+	"github.com/vicxqh/srp/types"
 
 	flag "github.com/spf13/pflag"
 	"github.com/vicxqh/srp/log"
@@ -16,6 +19,25 @@ var (
 	name        string
 	description string
 	server      string
+	token       string
+
+	transportName string
+	tlsCA         string
+	tlsServerName string
+	tlsCert       string
+	tlsKey        string
+
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+
+	retryInterval    time.Duration
+	maxRetryInterval time.Duration
+	maxRetries       int
+
+	connections int
+
+	servicesFile string
+	allow        []string
 )
 
 func init() {
@@ -25,6 +47,27 @@ func init() {
 	flag.StringVar(&name, "name", hostname, "agent name(id)")
 	flag.StringVar(&description, "description", "", "more detailed description about this agent")
 	flag.StringVar(&server, "server", "", "srp server address")
+	flag.StringVar(&token, "token", os.Getenv("SRP_AGENT_TOKEN"),
+		"token issued by the server for this agent, $SRP_AGENT_TOKEN by default")
+	flag.StringVar(&transportName, "transport", transport.Plain, "transport of the data connection.[plain|tls]")
+	flag.StringVar(&tlsCA, "tls-ca", "", "CA bundle to verify the server certificate, system CAs by default")
+	flag.StringVar(&tlsServerName, "tls-server-name", "", "name in the server certificate, host of --server by default")
+	flag.StringVar(&tlsCert, "tls-cert", "", "client certificate issued to the agent name, if the server requires one")
+	flag.StringVar(&tlsKey, "tls-key", "", "private key file of tls-cert")
+	flag.DurationVar(&heartbeatInterval, "heartbeat-interval", 15*time.Second, "how often the server is pinged, 0 disables it")
+	flag.DurationVar(&heartbeatTimeout, "heartbeat-timeout", 45*time.Second,
+		"reconnect if the server stays silent for longer")
+	flag.DurationVar(&retryInterval, "retry-interval", time.Second,
+		"wait after the first failed connection, doubled after every further failure")
+	flag.DurationVar(&maxRetryInterval, "max-retry-interval", time.Minute, "the longest wait between connections")
+	flag.IntVar(&maxRetries, "max-retries", 0, "exit after this many failed retries in a row, 0 retries forever")
+	flag.IntVar(&connections, "connections", 1,
+		"how many data connections to open in parallel, streams are spread over them")
+	flag.StringVar(&servicesFile, "services", "",
+		`json file of services offered by this agent, like [{"ID": "web", "Addr": "127.0.0.1:80"}]`)
+	flag.StringSliceVar(&allow, "allow", nil,
+		"destinations the server may make this agent dial, CIDRs, host:port or \"declared\" for the addresses of "+
+			"--services. Everything is allowed if empty")
 }
 
 func main() {
@@ -40,5 +83,38 @@ func main() {
 		os.Exit(1)
 	}
 
-	internal.ConnectToServer(server, name, description)
+	var services []types.Service
+	if servicesFile != "" {
+		if services, err = internal.LoadServices(servicesFile); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	err = internal.ConnectToServer(internal.Config{
+		Server:        server,
+		Name:          name,
+		Description:   description,
+		Token:         token,
+		Transport:     transportName,
+		TLSCA:         tlsCA,
+		TLSServerName: tlsServerName,
+		TLSCert:       tlsCert,
+		TLSKey:        tlsKey,
+
+		HeartbeatInterval: heartbeatInterval,
+		HeartbeatTimeout:  heartbeatTimeout,
+
+		RetryInterval:    retryInterval,
+		MaxRetryInterval: maxRetryInterval,
+		MaxRetries:       maxRetries,
+
+		Connections: connections,
+		Services:    services,
+		Allow:       allow,
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
@@ -2,6 +2,7 @@ package proto
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
@@ -9,87 +10,395 @@ import (
 
 // Header
 //
-// 0                                 31
-// +---------------------------------+  ---+
-// |             user ip             |     |
-// +---------------------------------+     |
-// |            service ip           |     |
-// +----------------+----------------+     |-- 16 bytes
-// |    user port   |  service port  |     |
-// +---------------------------------+     |
-// |          payload length         |     |
-// +----------------+----------------+  ---+
-// |                                 |
-// |            payload              |
-// |                                 |
-// +---------------------------------+
+// 0        8       16       24       31
+// +--------+--------+--------+--------+  ---+
+// |  type  |user len|svc len | flags  |     |
+// +--------+--------+--------+--------+     |
+// |             stream id             |     |-- 12 bytes
+// +-----------------------------------+     |
+// |          payload length           |     |
+// +-----------------------------------+  ---+
+// |           user address            |  user len bytes, OPEN only
+// +-----------------------------------+
+// |          service address          |  svc len bytes, OPEN only
+// +-----------------------------------+
+// |                                   |
+// |             payload               |
+// |                                   |
+// +-----------------------------------+
 //
+// Address
+//
+// +--------+------------------+-------------+
+// |  kind  |       host       |    port     |
+// +--------+------------------+-------------+
+//
+//	1 byte   4 bytes(ipv4)      2 bytes
+//	         16 bytes(ipv6)
+//	         16+n bytes(ipv6 with n bytes zone)
+//	         n bytes(hostname)
+//
+// Flags
+//
+// +-------+-------+-------+-------+-------+-------+-------+-------+
+// |   0   |   0   |   0   |   0   |   0   | proxy protocol|network|
+// +-------+-------+-------+-------+-------+-------+-------+-------+
+//
+//	network: 0 for tcp, 1 for udp
+//	proxy protocol: version of the PROXY protocol header sent to the service, 0 for none
 type Header []byte
 
-const HeaderSize = 16 //16bytes, since we only support ipV4
+// FixedHeaderSize is the size of the part of a header that precedes the addresses.
+const FixedHeaderSize = 12
+
+// Type tells how a segment should be handled by the receiver.
+type Type byte
+
+const (
+	// TypeOpen asks the agent to connect to the service on behalf of a new user.
+	// It is the only type that carries addresses, later segments of the stream refer to it by stream id.
+	TypeOpen Type = iota + 1
+	// TypeData carries payload between a user and a service.
+	TypeData
+	// TypeClose tells the peer that this side of the stream finished normally.
+	// Pending data is flushed before the connection is closed.
+	TypeClose
+	// TypeReset tells the peer that the stream is broken and must be torn down immediately.
+	// The payload is an optional reason in text, for the log of the peer.
+	TypeReset
+	// TypeWindowUpdate grants the peer more bytes to send on the stream.
+	// The payload is a 4 bytes big endian increment.
+	TypeWindowUpdate
+	// TypeHandshake carries the registration of an agent and the reply of the server, as json payload.
+	// It is exchanged once on stream 0, before any other segment.
+	TypeHandshake
+	// TypePing asks the peer to prove that the link is alive, it is answered by a PONG on stream 0.
+	TypePing
+	// TypePong answers a PING.
+	TypePong
+	// TypeAck tells the peer how many segments of the session have been received, so that it stops
+	// keeping them for a resumption. The payload is an 8 bytes big endian count.
+	TypeAck
+	// TypeDatagram carries one datagram between a user and a service of a udp stream, a datagram is never
+	// split or merged with others. Datagrams are not flow controlled, they are dropped instead.
+	TypeDatagram
+)
+
+// networks of streams, told by the flags of OPEN headers
+const (
+	NetworkTCP = "tcp"
+	NetworkUDP = "udp"
+)
+
+// bits of the flags of OPEN headers
+const (
+	flagUDP                byte = 1
+	flagProxyProtocolShift      = 1
+	flagProxyProtocol      byte = 3 << flagProxyProtocolShift
+)
+
+// Version is the version of the protocol spoken by this build, MinVersion is the oldest one it still speaks.
+// Peers agree on the highest version both of them speak.
+const (
+	Version    = 1
+	MinVersion = 1
+)
+
+// optional features
+const (
+	// CapHeartbeat means that the peer answers PING segments.
+	CapHeartbeat = "heartbeat"
+	// CapResume means that the peer is able to resume a session on a new link after the old one dropped.
+	CapResume = "resume"
+	// CapPool means that the peer is able to carry the streams of an agent over a pool of links.
+	CapPool = "pool"
+	// CapDatagram means that the peer is able to carry udp streams.
+	CapDatagram = "datagram"
+	// CapProxyProtocol means that the agent is able to tell services about users by PROXY protocol headers.
+	CapProxyProtocol = "proxy-protocol"
+)
+
+// Capabilities are the optional features supported by this build. Only features supported by both peers
+// are used on a link.
+var Capabilities = []string{CapHeartbeat, CapResume, CapPool, CapDatagram, CapProxyProtocol}
+
+// HasCapability tells whether capability is in capabilities.
+func HasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
 
+// Negotiate returns the capabilities in both ours and theirs.
+func Negotiate(ours, theirs []string) []string {
+	var both []string
+	for _, c := range ours {
+		for _, t := range theirs {
+			if c == t {
+				both = append(both, c)
+				break
+			}
+		}
+	}
+	return both
+}
+
+// MaxPayloadLength limits the payload of a segment, so that a broken peer can not make the receiver
+// allocate gigabytes.
+const MaxPayloadLength = 1 << 20
+
+// InitialWindowSize is how many bytes each side may send on a new stream before it is granted more by
+// WINDOW_UPDATE segments.
+const InitialWindowSize = 256 * 1024
+
+func (t Type) String() string {
+	switch t {
+	case TypeOpen:
+		return "OPEN"
+	case TypeData:
+		return "DATA"
+	case TypeClose:
+		return "CLOSE"
+	case TypeReset:
+		return "RESET"
+	case TypeWindowUpdate:
+		return "WINDOW_UPDATE"
+	case TypeHandshake:
+		return "HANDSHAKE"
+	case TypePing:
+		return "PING"
+	case TypePong:
+		return "PONG"
+	case TypeAck:
+		return "ACK"
+	case TypeDatagram:
+		return "DATAGRAM"
+	}
+	return fmt.Sprintf("Unknown-Type(%d)", byte(t))
+}
+
+// kinds of address
+const (
+	addrIPv4     byte = 1
+	addrHostname byte = 3
+	addrIPv6     byte = 4
+	addrIPv6Zone byte = 5
+)
+
+func (h Header) Type() Type {
+	return Type(h[0])
+}
+
+// Stream returns the id of the stream that the segment belongs to. Ids are assigned by the server.
+func (h Header) Stream() uint32 {
+	return uint32(h[4])<<24 | uint32(h[5])<<16 | uint32(h[6])<<8 | uint32(h[7])
+}
+
+// Size returns the size of the whole header, including addresses.
+func (h Header) Size() int {
+	return FixedHeaderSize + int(h[1]) + int(h[2])
+}
+
+// User returns the address of the user, it is empty unless h is an OPEN header.
 func (h Header) User() string {
-	ip := net.IPv4(h[0], h[1], h[2], h[3]).String()
-	port := fmt.Sprintf("%d", int(h[8])<<8|int(h[9]))
-	return ip + ":" + port
+	return decodeAddr(h[FixedHeaderSize : FixedHeaderSize+int(h[1])])
 }
 
+// Service returns the address of the service, it is empty unless h is an OPEN header.
 func (h Header) Service() string {
-	ip := net.IPv4(h[4], h[5], h[6], h[7]).String()
-	port := fmt.Sprintf("%d", int(h[10])<<8|int(h[11]))
-	return ip + ":" + port
+	begin := FixedHeaderSize + int(h[1])
+	return decodeAddr(h[begin : begin+int(h[2])])
+}
+
+// Network returns the network of the stream that h opens, NetworkTCP or NetworkUDP.
+func (h Header) Network() string {
+	if h[3]&flagUDP != 0 {
+		return NetworkUDP
+	}
+	return NetworkTCP
+}
+
+// SetNetwork sets the network of the stream that h opens, streams are NetworkTCP unless set otherwise.
+func (h Header) SetNetwork(network string) {
+	if network == NetworkUDP {
+		h[3] |= flagUDP
+	} else {
+		h[3] &^= flagUDP
+	}
+}
+
+// ProxyProtocol returns the version of the PROXY protocol header that the agent sends to the service before
+// anything else of the stream, 0 if the service is not told about the user.
+func (h Header) ProxyProtocol() int {
+	return int(h[3]&flagProxyProtocol) >> flagProxyProtocolShift
+}
+
+// SetProxyProtocol sets the version of the PROXY protocol header for the stream that h opens, 1 or 2, or 0
+// for none.
+func (h Header) SetProxyProtocol(version int) {
+	h[3] = h[3]&^flagProxyProtocol | byte(version)<<flagProxyProtocolShift&flagProxyProtocol
 }
 
 // SetPayloadLength set length of data payload. Length can NOT exceed uint32
 func (h Header) SetPayloadLength(l uint32) {
-	h[12] = byte(l >> 24)
-	h[13] = byte(l >> 16)
-	h[14] = byte(l >> 8)
-	h[15] = byte(l)
+	h[8] = byte(l >> 24)
+	h[9] = byte(l >> 16)
+	h[10] = byte(l >> 8)
+	h[11] = byte(l)
 }
 
 func (h Header) PayloadLength() uint32 {
-	return uint32(h[12])<<24 | uint32(h[13])<<16 | uint32(h[14])<<8 | uint32(h[15])
+	return uint32(h[8])<<24 | uint32(h[9])<<16 | uint32(h[10])<<8 | uint32(h[11])
 }
 
-func NewHeader(user, service string) (Header, error) {
-	uip, uport, err := parseAddr(user)
+// NewHeader creates a header of stream without addresses.
+func NewHeader(typ Type, stream uint32) Header {
+	h := make(Header, FixedHeaderSize)
+	h[0] = byte(typ)
+	h[4] = byte(stream >> 24)
+	h[5] = byte(stream >> 16)
+	h[6] = byte(stream >> 8)
+	h[7] = byte(stream)
+	return h
+}
+
+// NewOpenHeader creates the OPEN header of a new stream from user to service.
+func NewOpenHeader(stream uint32, user, service string) (Header, error) {
+	uaddr, err := encodeAddr(user)
 	if err != nil {
 		return nil, err
 	}
-	sip, sport, err := parseAddr(service)
+	saddr, err := encodeAddr(service)
 	if err != nil {
 		return nil, err
 	}
-	h := make([]byte, HeaderSize)
-	copy(h, []byte{
-		uip[0], uip[1], uip[2], uip[3],
-		sip[0], sip[1], sip[2], sip[3],
-		byte(uport >> 8), byte(uport), byte(sport >> 8), byte(sport),
-	})
+	h := NewHeader(TypeOpen, stream)
+	h[1] = byte(len(uaddr))
+	h[2] = byte(len(saddr))
+	h = append(h, uaddr...)
+	h = append(h, saddr...)
 	return h, nil
 }
 
-func parseAddr(addr string) (ip net.IP, port int, err error) {
-	ss := strings.Split(addr, ":")
-	if len(ss) != 2 {
-		err = fmt.Errorf("%s is not a valid address, expected ip:port", addr)
-		return
+// ReadHeader reads a whole header from r.
+func ReadHeader(r io.Reader) (Header, error) {
+	fixed := make(Header, FixedHeaderSize)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	if fixed.Type() != TypeOpen && (fixed[1] != 0 || fixed[2] != 0) {
+		return nil, fmt.Errorf("malformed header, %s segment carries addresses", fixed.Type())
+	}
+	if fixed.PayloadLength() > MaxPayloadLength {
+		return nil, fmt.Errorf("payload of %d bytes exceeds the limit of %d", fixed.PayloadLength(), MaxPayloadLength)
+	}
+	h := make(Header, fixed.Size())
+	copy(h, fixed)
+	if _, err := io.ReadFull(r, h[FixedHeaderSize:]); err != nil {
+		return nil, err
 	}
-	ip = net.ParseIP(ss[0])
-	ip = ip.To4()
-	if ip == nil {
-		err = fmt.Errorf("%s is not a valid ip", ss[0])
+	return h, nil
+}
+
+func encodeAddr(addr string) ([]byte, error) {
+	ip, zone, host, port, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	if zone != "" {
+		b = append([]byte{addrIPv6Zone}, ip.To16()...)
+		b = append(b, zone...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{addrIPv4}, ip4...)
+	} else if ip != nil {
+		b = append([]byte{addrIPv6}, ip.To16()...)
+	} else {
+		b = append([]byte{addrHostname}, host...)
+	}
+	b = append(b, byte(port>>8), byte(port))
+	if len(b) > 255 {
+		return nil, fmt.Errorf("address %s is too long", addr)
+	}
+	return b, nil
+}
+
+func decodeAddr(b []byte) string {
+	if len(b) < 3 {
+		return ""
+	}
+	host := b[1 : len(b)-2]
+	port := strconv.Itoa(int(b[len(b)-2])<<8 | int(b[len(b)-1]))
+	switch b[0] {
+	case addrIPv4, addrIPv6:
+		return net.JoinHostPort(net.IP(host).String(), port)
+	case addrIPv6Zone:
+		if len(host) <= net.IPv6len {
+			return ""
+		}
+		return net.JoinHostPort(net.IP(host[:net.IPv6len]).String()+"%"+string(host[net.IPv6len:]), port)
+	}
+	return net.JoinHostPort(string(host), port)
+}
+
+// parseAddr parses addr as host:port, where host is either an ip(v4 or v6, with an optional zone for v6)
+// or a hostname. Exactly one of ip and hostname is set on success.
+func parseAddr(addr string) (ip net.IP, zone, hostname string, port int, err error) {
+	var h, p string
+	h, p, err = net.SplitHostPort(addr)
+	if err != nil {
+		err = fmt.Errorf("%s is not a valid address, expected host:port, %v", addr, err)
 		return
 	}
-	port, err = strconv.Atoi(ss[1])
+	port, err = strconv.Atoi(p)
 	if err != nil {
-		err = fmt.Errorf("%s is not an int, %v", ss[1], err)
+		err = fmt.Errorf("%s is not an int, %v", p, err)
 		return
 	}
 	if port <= 0 || port > 65535 {
 		err = fmt.Errorf("port %d is not valid", port)
 		return
 	}
+	if ip = net.ParseIP(h); ip != nil {
+		return
+	}
+	if i := strings.LastIndexByte(h, '%'); i > 0 && i < len(h)-1 {
+		// zoned ipv6 like fe80::1%eth0, which is what link-local users show up as
+		if ip = net.ParseIP(h[:i]); ip != nil && ip.To4() == nil {
+			zone = h[i+1:]
+			return
+		}
+		ip = nil
+	}
+	if !isHostname(h) {
+		err = fmt.Errorf("%s is neither a valid ip nor a valid hostname", h)
+		return
+	}
+	hostname = h
 	return
 }
+
+// isHostname checks s against RFC 1123. The last label must not be all digits, so that a malformed
+// ipv4 like 192.168.2.256 is not taken as a hostname.
+func isHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if len(s) == 0 || len(s) > 253 {
+		return false
+	}
+	labels := strings.Split(s, ".")
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	_, err := strconv.Atoi(labels[len(labels)-1])
+	return err != nil
+}
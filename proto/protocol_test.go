@@ -1,6 +1,7 @@
 package proto
 
 import (
+	"bytes"
 	"net"
 	"testing"
 
@@ -10,41 +11,87 @@ import (
 func TestParseAddr(t *testing.T) {
 	require := require.New(t)
 	var ip net.IP
+	var hostname string
 	var port int
 	var err error
 
-	ip, port, err = parseAddr("192.168.2.1")
+	ip, _, _, port, err = parseAddr("192.168.2.1")
 	require.NotNil(err)
 
-	ip, port, err = parseAddr("192.168.2.1:11:11")
+	ip, _, _, port, err = parseAddr("192.168.2.1:11:11")
 	require.NotNil(err)
 
-	ip, port, err = parseAddr("192.168.2.256:11")
+	ip, _, _, port, err = parseAddr("192.168.2.256:11")
 	require.NotNil(err)
 
-	ip, port, err = parseAddr("192.168.2.255:0")
+	ip, _, _, port, err = parseAddr("192.168.2.255:0")
 	require.NotNil(err)
 
-	ip, port, err = parseAddr("192.168.2.255:65536")
+	ip, _, _, port, err = parseAddr("192.168.2.255:65536")
 	require.NotNil(err)
 
-	ip, port, err = parseAddr("192.168.2.255:1")
+	ip, _, _, port, err = parseAddr("192.168.2.255:1")
 	require.Nil(err)
 	require.Equal(1, port)
 	require.True(ip.Equal(net.IPv4(192, 168, 2, 255)))
 
-	ip, port, err = parseAddr("192.168.2.255:65535")
+	ip, _, _, port, err = parseAddr("192.168.2.255:65535")
 	require.Nil(err)
 	require.Equal(65535, port)
+
+	ip, _, _, port, err = parseAddr("[fd00::1]:443")
+	require.Nil(err)
+	require.Equal(443, port)
+	require.True(ip.Equal(net.ParseIP("fd00::1")))
+
+	var zone string
+	ip, zone, _, port, err = parseAddr("[fe80::1%eth0]:50000")
+	require.Nil(err)
+	require.Equal(50000, port)
+	require.Equal("eth0", zone)
+	require.True(ip.Equal(net.ParseIP("fe80::1")))
+
+	_, _, _, _, err = parseAddr("[192.168.2.1%eth0]:80")
+	require.NotNil(err)
+
+	ip, _, hostname, port, err = parseAddr("wiki.intranet:80")
+	require.Nil(err)
+	require.Nil(ip)
+	require.Equal("wiki.intranet", hostname)
+	require.Equal(80, port)
+
+	_, _, _, _, err = parseAddr("-wiki.intranet:80")
+	require.NotNil(err)
+
+	_, _, _, _, err = parseAddr("wiki_intranet:80")
+	require.NotNil(err)
 }
 
 func TestHeader(t *testing.T) {
 	require := require.New(t)
 
-	h, err := NewHeader("1.2.3.4:5", "192.168.1.255:8080")
+	h, err := NewOpenHeader(4294967295, "1.2.3.4:5", "192.168.1.255:8080")
 	require.Nil(err)
+	require.Equal(TypeOpen, h.Type())
+	require.Equal(uint32(4294967295), h.Stream())
 	require.Equal("1.2.3.4:5", h.User())
 	require.Equal("192.168.1.255:8080", h.Service())
+	require.Equal(NetworkTCP, h.Network())
+	require.Equal(0, h.ProxyProtocol())
+	h.SetNetwork(NetworkUDP)
+	require.Equal(NetworkUDP, h.Network())
+	require.Equal("192.168.1.255:8080", h.Service())
+	h.SetProxyProtocol(2)
+	require.Equal(2, h.ProxyProtocol())
+	require.Equal(NetworkUDP, h.Network())
+	h.SetNetwork(NetworkTCP)
+	require.Equal(NetworkTCP, h.Network())
+	require.Equal(2, h.ProxyProtocol())
+	h.SetProxyProtocol(1)
+	require.Equal(1, h.ProxyProtocol())
+	h.SetProxyProtocol(0)
+	require.Equal(0, h.ProxyProtocol())
+	require.Equal(NetworkTCP, h.Network())
 
 	h.SetPayloadLength(4294967295)
 	require.Equal(uint32(4294967295), h.PayloadLength())
@@ -53,3 +100,80 @@ func TestHeader(t *testing.T) {
 	h.SetPayloadLength(123456789)
 	require.Equal(uint32(123456789), h.PayloadLength())
 }
+
+func TestHeaderType(t *testing.T) {
+	require := require.New(t)
+
+	for _, typ := range []Type{TypeData, TypeClose, TypeReset, TypeDatagram} {
+		h := NewHeader(typ, 7)
+		require.Equal(typ, h.Type())
+		require.Equal(uint32(7), h.Stream())
+		require.Equal(FixedHeaderSize, h.Size())
+		require.Equal("", h.User())
+		require.Equal("", h.Service())
+	}
+	require.Equal("CLOSE", TypeClose.String())
+	require.Equal("DATAGRAM", TypeDatagram.String())
+}
+
+func TestHeaderAddresses(t *testing.T) {
+	require := require.New(t)
+
+	cases := []struct {
+		user, service string
+	}{
+		{"[2001:db8::1]:50000", "[fd00::10]:22"},
+		{"1.2.3.4:5", "[::1]:8080"},
+		{"[2001:db8::1]:50000", "wiki.intranet:80"},
+		{"1.2.3.4:5", "localhost:3306"},
+		{"[fe80::1%eth0]:50000", "[fe80::abcd%2]:22"},
+	}
+	for _, c := range cases {
+		h, err := NewOpenHeader(1, c.user, c.service)
+		require.Nil(err)
+		require.Equal(c.user, h.User())
+		require.Equal(c.service, h.Service())
+		require.Equal(len(h), h.Size())
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	require := require.New(t)
+
+	h, err := NewOpenHeader(1, "[2001:db8::1]:50000", "wiki.intranet:80")
+	require.Nil(err)
+	h.SetPayloadLength(3)
+	buf := bytes.NewBuffer(append(append([]byte{}, h...), 'a', 'b', 'c'))
+
+	r, err := ReadHeader(buf)
+	require.Nil(err)
+	require.Equal(h, r)
+	require.Equal("abc", buf.String())
+
+	_, err = ReadHeader(bytes.NewBuffer(h[:len(h)-1]))
+	require.NotNil(err)
+
+	// raw json of an agent that predates framed handshakes
+	_, err = ReadHeader(bytes.NewBufferString(`{"ID":"agent","Description":""}`))
+	require.NotNil(err)
+
+	h = NewHeader(TypeData, 1)
+	h.SetPayloadLength(MaxPayloadLength + 1)
+	_, err = ReadHeader(bytes.NewBuffer(h))
+	require.NotNil(err)
+}
+
+func TestNegotiate(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal([]string{"b", "c"}, Negotiate([]string{"a", "b", "c"}, []string{"c", "b", "d"}))
+	require.Empty(Negotiate([]string{"a"}, nil))
+	require.Empty(Negotiate(nil, []string{"a"}))
+}
+
+func TestHasCapability(t *testing.T) {
+	require := require.New(t)
+
+	require.True(HasCapability(Capabilities, CapHeartbeat))
+	require.False(HasCapability(nil, CapHeartbeat))
+}
@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/vicxqh/srp/log"
+	"github.com/vicxqh/srp/types"
+)
+
+// APIKeyMeta is what is stored for an api key, keyed by the hash of the key.
+type APIKeyMeta struct {
+	Name    string
+	Role    types.Role
+	Created time.Time
+}
+
+func listAPIKeys() ([]types.APIKey, error) {
+	var keys []types.APIKey
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketAPIKey).ForEach(func(k, v []byte) error {
+			var meta APIKeyMeta
+			if err := json.Unmarshal(v, &meta); err != nil {
+				return err
+			}
+			keys = append(keys, types.APIKey{Name: meta.Name, Role: meta.Role, Created: meta.Created})
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// createAPIKey creates a key named name with role, and returns it with the key itself, which is never
+// shown again.
+func createAPIKey(name string, role types.Role) (types.APIKey, error) {
+	key := types.APIKey{Name: name, Role: role, Created: time.Now()}
+	if name == "" {
+		return key, errors.New("name of api key is required")
+	}
+	if role != types.RoleRead && role != types.RoleAdmin {
+		return key, fmt.Errorf("unknown role %s, expected %s or %s", role, types.RoleRead, types.RoleAdmin)
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return key, err
+	}
+	key.Key = hex.EncodeToString(b)
+	data, err := json.Marshal(APIKeyMeta{Name: key.Name, Role: key.Role, Created: key.Created})
+	if err != nil {
+		return key, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketAPIKey)
+		exists := false
+		bucket.ForEach(func(k, v []byte) error {
+			var meta APIKeyMeta
+			if json.Unmarshal(v, &meta) == nil && meta.Name == name {
+				exists = true
+			}
+			return nil
+		})
+		if exists {
+			return ErrAlreadyExist
+		}
+		return bucket.Put([]byte(hashToken(key.Key)), data)
+	})
+	return key, err
+}
+
+func deleteAPIKey(name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketAPIKey)
+		var hash []byte
+		bucket.ForEach(func(k, v []byte) error {
+			var meta APIKeyMeta
+			if json.Unmarshal(v, &meta) == nil && meta.Name == name {
+				hash = append([]byte{}, k...)
+			}
+			return nil
+		})
+		if hash == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete(hash)
+	})
+}
+
+// lookupAPIKey returns the meta of key, or nil if there is no such key.
+func lookupAPIKey(key string) (*APIKeyMeta, error) {
+	var meta *APIKeyMeta
+	err := db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(BucketAPIKey).Get([]byte(hashToken(key)))
+		if data == nil {
+			return nil
+		}
+		meta = &APIKeyMeta{}
+		return json.Unmarshal(data, meta)
+	})
+	return meta, err
+}
+
+func hasAPIKeys() bool {
+	has := false
+	db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket(BucketAPIKey).Cursor().First()
+		has = k != nil
+		return nil
+	})
+	return has
+}
+
+// apiKeyFromRequest accepts both "Authorization: Bearer <key>" and "X-API-Key: <key>".
+func apiKeyFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// fromLoopback tells whether r is sent from the host of the server. Forwarding headers are not trusted.
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authenticate is a middleware which requires a read key for GET requests, and an admin key for the others.
+// It lets everything through while no key is configured, so that existing setups keep working, except for
+// creating the first key, which only the host of the server may do.
+func (s *Server) authenticate(c *gin.Context) {
+	if s.config.AdminKey == "" && !hasAPIKeys() {
+		// otherwise anyone reaching the api could make itself admin
+		if strings.HasSuffix(c.FullPath(), "/apikeys") && c.Request.Method != http.MethodGet &&
+			!fromLoopback(c.Request) {
+			c.AbortWithStatusJSON(http.StatusForbidden,
+				"the first api key is created with --admin-key, or from the host of the server")
+			return
+		}
+		c.Next()
+		return
+	}
+	required := types.RoleAdmin
+	if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+		required = types.RoleRead
+	}
+
+	key := apiKeyFromRequest(c.Request)
+	if key == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, "api key is required")
+		return
+	}
+	var role types.Role
+	if s.config.AdminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(s.config.AdminKey)) == 1 {
+		role = types.RoleAdmin
+	} else {
+		meta, err := lookupAPIKey(key)
+		if err != nil {
+			log.Error("failed to look up api key, %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if meta == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "invalid api key")
+			return
+		}
+		role = meta.Role
+	}
+	if required == types.RoleAdmin && role != types.RoleAdmin {
+		c.AbortWithStatusJSON(http.StatusForbidden, "admin role is required")
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"github.com/vicxqh/srp/types"
+)
+
+// testAPI serves some routes of the api behind authenticate, each handler just says OK.
+func testAPI(config Config) http.Handler {
+	gin.SetMode(gin.ReleaseMode)
+	s := &Server{config: config}
+	router := gin.New()
+	api := router.Group("/api/v1", s.authenticate)
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	api.GET("apikeys", ok)
+	api.POST("apikeys", ok)
+	api.DELETE("apikeys/:name", ok)
+	api.PUT("services/:id", ok)
+	return router
+}
+
+// callAPI sends a request from remote with key, and returns the status code.
+func callAPI(handler http.Handler, method, path, key, remote string) int {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = remote
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	rsp := httptest.NewRecorder()
+	handler.ServeHTTP(rsp, req)
+	return rsp.Code
+}
+
+const (
+	remoteAddr   = "192.0.2.1:40000"
+	loopbackAddr = "127.0.0.1:40000"
+)
+
+func TestAuthenticate(t *testing.T) {
+	require := require.New(t)
+	useTestDB(t)
+	api := testAPI(Config{})
+
+	// the api is open while no key exists, but only the host of the server creates the first key
+	require.Equal(http.StatusOK, callAPI(api, http.MethodGet, "/api/v1/apikeys", "", remoteAddr))
+	require.Equal(http.StatusForbidden, callAPI(api, http.MethodPost, "/api/v1/apikeys", "", remoteAddr))
+	require.Equal(http.StatusOK, callAPI(api, http.MethodPost, "/api/v1/apikeys", "", loopbackAddr))
+	require.Equal(http.StatusOK, callAPI(api, http.MethodPost, "/api/v1/apikeys", "", "[::1]:40000"))
+
+	admin, err := createAPIKey("admin", types.RoleAdmin)
+	require.NoError(err)
+	read, err := createAPIKey("read", types.RoleRead)
+	require.NoError(err)
+
+	require.Equal(http.StatusUnauthorized, callAPI(api, http.MethodGet, "/api/v1/apikeys", "", loopbackAddr))
+	require.Equal(http.StatusUnauthorized, callAPI(api, http.MethodGet, "/api/v1/apikeys", "unknown", remoteAddr))
+	require.Equal(http.StatusOK, callAPI(api, http.MethodGet, "/api/v1/apikeys", read.Key, remoteAddr))
+	require.Equal(http.StatusForbidden, callAPI(api, http.MethodPut, "/api/v1/services/web", read.Key, remoteAddr))
+	require.Equal(http.StatusForbidden, callAPI(api, http.MethodPost, "/api/v1/apikeys", read.Key, remoteAddr))
+	require.Equal(http.StatusForbidden, callAPI(api, http.MethodDelete, "/api/v1/apikeys/read", read.Key, remoteAddr))
+	require.Equal(http.StatusOK, callAPI(api, http.MethodGet, "/api/v1/apikeys", admin.Key, remoteAddr))
+	require.Equal(http.StatusOK, callAPI(api, http.MethodPost, "/api/v1/apikeys", admin.Key, remoteAddr))
+	require.Equal(http.StatusOK, callAPI(api, http.MethodDelete, "/api/v1/apikeys/read", admin.Key, remoteAddr))
+
+	// X-API-Key works as well
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/apikeys", nil)
+	req.Header.Set("X-API-Key", read.Key)
+	rsp := httptest.NewRecorder()
+	api.ServeHTTP(rsp, req)
+	require.Equal(http.StatusOK, rsp.Code)
+}
+
+func TestAuthenticateAdminKey(t *testing.T) {
+	require := require.New(t)
+	useTestDB(t)
+	api := testAPI(Config{AdminKey: "secret"})
+
+	// the api requires a key as soon as the admin key is configured, even if no key is stored
+	require.Equal(http.StatusUnauthorized, callAPI(api, http.MethodGet, "/api/v1/apikeys", "", loopbackAddr))
+	require.Equal(http.StatusUnauthorized, callAPI(api, http.MethodPost, "/api/v1/apikeys", "", loopbackAddr))
+	require.Equal(http.StatusUnauthorized, callAPI(api, http.MethodPost, "/api/v1/apikeys", "wrong", remoteAddr))
+	require.Equal(http.StatusOK, callAPI(api, http.MethodPost, "/api/v1/apikeys", "secret", remoteAddr))
+
+	// keys stored in the db still work next to the admin key
+	read, err := createAPIKey("read", types.RoleRead)
+	require.NoError(err)
+	require.Equal(http.StatusOK, callAPI(api, http.MethodGet, "/api/v1/apikeys", read.Key, remoteAddr))
+	require.Equal(http.StatusForbidden, callAPI(api, http.MethodPost, "/api/v1/apikeys", read.Key, remoteAddr))
+	require.Equal(http.StatusOK, callAPI(api, http.MethodDelete, "/api/v1/apikeys/read", "secret", remoteAddr))
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/vicxqh/srp/transport"
+	"github.com/vicxqh/srp/transport/tls"
+	"github.com/vicxqh/srp/types"
+)
+
+// permanentError is a rejection that the agent can not fix by retrying, it is told not to.
+type permanentError struct {
+	error
+}
+
+// verifyAgent checks that a registering agent is who it claims to be. It tells whether the agent proved it,
+// by a client certificate or a token, rather than being let in because nothing is required.
+func (s *Server) verifyAgent(t transport.Transport, req types.AgentRegistrationRequest) (bool, error) {
+	if s.config.TLSClientCA != "" {
+		tc, ok := t.(*tls.Connection)
+		if !ok {
+			return false, permanentError{fmt.Errorf("agent %s did not connect over tls", req.ID)}
+		}
+		if err := tc.VerifyPeerName(req.ID); err != nil {
+			return false, permanentError{fmt.Errorf("agent %s is not authorized, %v", req.ID, err)}
+		}
+		_, err := s.verifyAgentToken(req.ID, req.Token)
+		return err == nil, err
+	}
+	return s.verifyAgentToken(req.ID, req.Token)
+}
+
+// AgentTokenMeta is what is stored for a token issued to an agent.
+type AgentTokenMeta struct {
+	Hash    string // hex encoded sha256 of the token
+	Created time.Time
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func getAgentToken(id string) (*AgentTokenMeta, error) {
+	var meta *AgentTokenMeta
+	err := db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(BucketAgentToken).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		meta = &AgentTokenMeta{}
+		return json.Unmarshal(data, meta)
+	})
+	return meta, err
+}
+
+// verifyAgentToken checks token against the one issued to agent id, and tells whether it matched. An agent
+// without an issued token is accepted with any token, unless the server requires tokens.
+func (s *Server) verifyAgentToken(id, token string) (bool, error) {
+	meta, err := getAgentToken(id)
+	if err != nil {
+		return false, fmt.Errorf("failed to load token of agent %s, %v", id, err)
+	}
+	if meta == nil {
+		if s.config.RequireAgentToken {
+			return false, permanentError{fmt.Errorf("agent %s has no token issued, ask the server admin for one", id)}
+		}
+		return false, nil
+	}
+	if token == "" {
+		return false, permanentError{fmt.Errorf("agent %s requires a token", id)}
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(meta.Hash)) != 1 {
+		return false, permanentError{fmt.Errorf("invalid token for agent %s", id)}
+	}
+	return true, nil
+}
+
+// issueAgentToken creates a new token for agent id, replacing the old one if any.
+func issueAgentToken(id string) (string, error) {
+	if id == "" {
+		return "", errors.New("agent id is required")
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	data, err := json.Marshal(AgentTokenMeta{
+		Hash:    hashToken(token),
+		Created: time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketAgentToken).Put([]byte(id), data)
+	})
+	return token, err
+}
+
+func revokeAgentToken(id string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketAgentToken)
+		if bucket.Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
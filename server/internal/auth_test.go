@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentToken(t *testing.T) {
+	require := require.New(t)
+	useTestDB(t)
+	s := &Server{}
+	required := &Server{config: Config{RequireAgentToken: true}}
+
+	// no token is issued
+	verified, err := s.verifyAgentToken("a1", "")
+	require.NoError(err)
+	require.False(verified)
+	_, err = required.verifyAgentToken("a1", "")
+	require.IsType(permanentError{}, err)
+
+	_, err = issueAgentToken("")
+	require.Error(err)
+	token, err := issueAgentToken("a1")
+	require.NoError(err)
+	require.NotEmpty(token)
+	for _, server := range []*Server{s, required} {
+		verified, err = server.verifyAgentToken("a1", token)
+		require.NoError(err)
+		require.True(verified)
+
+		_, err = server.verifyAgentToken("a1", "")
+		require.IsType(permanentError{}, err)
+		_, err = server.verifyAgentToken("a1", "wrong")
+		require.IsType(permanentError{}, err)
+		// tokens are bound to their agents
+		verified, err = server.verifyAgentToken("a2", token)
+		require.False(verified)
+		if server == required {
+			require.IsType(permanentError{}, err)
+		} else {
+			require.NoError(err)
+		}
+	}
+
+	// a new token replaces the old one
+	newToken, err := issueAgentToken("a1")
+	require.NoError(err)
+	require.NotEqual(token, newToken)
+	_, err = s.verifyAgentToken("a1", token)
+	require.IsType(permanentError{}, err)
+	verified, err = s.verifyAgentToken("a1", newToken)
+	require.NoError(err)
+	require.True(verified)
+
+	// a revoked token no longer proves anything
+	require.NoError(revokeAgentToken("a1"))
+	require.Equal(ErrNotFound, revokeAgentToken("a1"))
+	verified, err = s.verifyAgentToken("a1", newToken)
+	require.NoError(err)
+	require.False(verified)
+	_, err = required.verifyAgentToken("a1", newToken)
+	require.IsType(permanentError{}, err)
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync/atomic"
+)
+
+// ways to choose an agent of an exposure for a new user connection
+const (
+	// BalanceRoundRobin takes the agents in turn.
+	BalanceRoundRobin = "round-robin"
+	// BalanceLeastConn takes the agent with the fewest streams.
+	BalanceLeastConn = "least-conn"
+	// BalanceHash takes the same agent for the same user IP, as long as that agent is connected.
+	BalanceHash = "hash"
+)
+
+func checkBalance(balance string) error {
+	switch balance {
+	case BalanceRoundRobin, BalanceLeastConn, BalanceHash:
+		return nil
+	}
+	return fmt.Errorf("unknown balance %s, expected %s, %s or %s", balance, BalanceRoundRobin, BalanceLeastConn,
+		BalanceHash)
+}
+
+// order returns the agents of exp in the order they are tried for a connection from user. Agents after
+// the first one are the fail-overs.
+func (exp *Exposure) order(user string) []string {
+	switch exp.Balance {
+	case BalanceLeastConn:
+		return leastConn(exp.Agents, func(id string) int {
+			if a := getAgent(id); a != nil {
+				return a.streamCount()
+			}
+			return 0
+		})
+	case BalanceHash:
+		host, _, err := net.SplitHostPort(user)
+		if err != nil {
+			host = user
+		}
+		return byHash(exp.Agents, host)
+	}
+	return roundRobin(exp.Agents, atomic.AddUint32(&exp.next, 1)-1)
+}
+
+func roundRobin(agents []string, next uint32) []string {
+	ordered := make([]string, 0, len(agents))
+	for i := range agents {
+		ordered = append(ordered, agents[(int(next%uint32(len(agents)))+i)%len(agents)])
+	}
+	return ordered
+}
+
+func leastConn(agents []string, count func(id string) int) []string {
+	counts := make(map[string]int, len(agents))
+	for _, id := range agents {
+		counts[id] = count(id)
+	}
+	ordered := append([]string(nil), agents...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return counts[ordered[i]] < counts[ordered[j]]
+	})
+	return ordered
+}
+
+// byHash orders agents by rendezvous hashing of key, so that a key keeps its agent when other agents are
+// added or removed.
+func byHash(agents []string, key string) []string {
+	weights := make(map[string]uint64, len(agents))
+	for _, id := range agents {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(id))
+		weights[id] = h.Sum64()
+	}
+	ordered := append([]string(nil), agents...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return weights[ordered[i]] > weights[ordered[j]]
+	})
+	return ordered
+}
@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundRobin(t *testing.T) {
+	require := require.New(t)
+
+	agents := []string{"a", "b", "c"}
+	require.Equal([]string{"a", "b", "c"}, roundRobin(agents, 0))
+	require.Equal([]string{"b", "c", "a"}, roundRobin(agents, 1))
+	require.Equal([]string{"a", "b", "c"}, roundRobin(agents, 3))
+	// wraps around with the counter
+	require.Equal([]string{"a", "b", "c"}, roundRobin(agents, ^uint32(0)))
+}
+
+func TestLeastConn(t *testing.T) {
+	require := require.New(t)
+
+	counts := map[string]int{"a": 3, "b": 1, "c": 3}
+	ordered := leastConn([]string{"a", "b", "c"}, func(id string) int { return counts[id] })
+	require.Equal([]string{"b", "a", "c"}, ordered)
+}
+
+func TestByHash(t *testing.T) {
+	require := require.New(t)
+
+	agents := []string{"a", "b", "c", "d"}
+	moved := 0
+	for i := 0; i < 100; i++ {
+		key := string(rune('A' + i))
+		ordered := byHash(agents, key)
+		require.ElementsMatch(agents, ordered)
+		require.Equal(ordered, byHash(agents, key))
+
+		// only keys of the removed agent move
+		rest := byHash([]string{"a", "b", "d"}, key)
+		if ordered[0] == "c" {
+			moved++
+			require.Equal(ordered[1], rest[0])
+		} else {
+			require.Equal(ordered[0], rest[0])
+		}
+	}
+	require.True(moved > 0 && moved < 100)
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenHost returns the host that an exposure bound to bind listens on. bind is an IP of this host, or
+// the name of an interface, which is listened on by its first address, IPv4 preferred. An empty bind
+// listens on all interfaces.
+func listenHost(bind string) (string, error) {
+	if bind == "" {
+		return "", nil
+	}
+	if ip := net.ParseIP(bind); ip != nil {
+		if ip.IsUnspecified() {
+			return ip.String(), nil
+		}
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return "", err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return ip.String(), nil
+			}
+		}
+		return "", fmt.Errorf("%s is not an address of this host", bind)
+	}
+
+	iface, err := net.InterfaceByName(bind)
+	if err != nil {
+		return "", fmt.Errorf("%s is neither an IP nor an interface, %v", bind, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	var ipv6 net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+		// link-local addresses are not reachable without a zone
+		if ipv6 == nil && !ipnet.IP.IsLinkLocalUnicast() {
+			ipv6 = ipnet.IP
+		}
+	}
+	if ipv6 == nil {
+		return "", fmt.Errorf("interface %s has no address to listen on", bind)
+	}
+	return ipv6.String(), nil
+}
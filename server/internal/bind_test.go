@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenHost(t *testing.T) {
+	require := require.New(t)
+
+	host, err := listenHost("")
+	require.NoError(err)
+	require.Equal("", host)
+	host, err = listenHost("127.0.0.1")
+	require.NoError(err)
+	require.Equal("127.0.0.1", host)
+	host, err = listenHost("::")
+	require.NoError(err)
+	require.Equal("::", host)
+
+	// an interface is listened on by its address
+	ifaces, err := net.Interfaces()
+	require.NoError(err)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			host, err = listenHost(iface.Name)
+			require.NoError(err)
+			require.Equal("127.0.0.1", host)
+		}
+	}
+
+	for _, invalid := range []string{"192.0.2.254", "no-such-interface"} {
+		_, err = listenHost(invalid)
+		require.Error(err, invalid)
+	}
+}
@@ -0,0 +1,255 @@
+package internal
+
+import (
+	gotls "crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/vicxqh/srp/log"
+	"github.com/vicxqh/srp/types"
+)
+
+// CertificateMeta is what is stored for the certificate of a service, keyed by service id.
+type CertificateMeta struct {
+	Cert   string
+	Key    string
+	Source string
+}
+
+// ErrCertificateFromDir is returned for changes through the api to a certificate loaded from the
+// certificate directory, which would be undone by the next reload.
+var ErrCertificateFromDir = errors.New("certificate is loaded from the certificate directory")
+
+// certificates caches the parsed certificates of services, keyed by service id. Entries are dropped
+// whenever the stored certificate changes.
+var certificates sync.Map
+
+// parseCertificate checks that cert and key are a PEM key pair, and returns it parsed.
+func parseCertificate(cert, key string) (*gotls.Certificate, error) {
+	pair, err := gotls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate, %v", err)
+	}
+	if pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+		return nil, fmt.Errorf("invalid certificate, %v", err)
+	}
+	return &pair, nil
+}
+
+// certificateInfo describes a stored certificate, without its key.
+func certificateInfo(meta CertificateMeta) (*types.Certificate, error) {
+	pair, err := parseCertificate(meta.Cert, meta.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &types.Certificate{
+		Source:   meta.Source,
+		DNSNames: pair.Leaf.DNSNames,
+		NotAfter: pair.Leaf.NotAfter,
+	}, nil
+}
+
+func getCertificateMeta(tx *bolt.Tx, serviceId string) (CertificateMeta, error) {
+	var meta CertificateMeta
+	data := tx.Bucket(BucketCertificate).Get([]byte(serviceId))
+	if data == nil {
+		return meta, ErrNotFound
+	}
+	err := json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// putCertificate stores the certificate of a service. A certificate loaded from the certificate directory
+// is replaced only by another one from the directory.
+func putCertificate(serviceId string, meta CertificateMeta) (*types.Certificate, error) {
+	info, err := certificateInfo(meta)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(BucketServiceMeta).Get([]byte(serviceId)) == nil {
+			return ErrNotFound
+		}
+		old, err := getCertificateMeta(tx, serviceId)
+		if err == nil && fromCertDir(old) && meta.Source == types.CertificateSourceAPI {
+			return ErrCertificateFromDir
+		}
+		return tx.Bucket(BucketCertificate).Put([]byte(serviceId), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	certificates.Delete(serviceId)
+	return info, nil
+}
+
+// deleteCertificate deletes the certificate of a service. Unless force is set, a certificate loaded from
+// the certificate directory is kept.
+func deleteCertificate(serviceId string, force bool) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		old, err := getCertificateMeta(tx, serviceId)
+		if err != nil {
+			return err
+		}
+		if fromCertDir(old) && !force {
+			return ErrCertificateFromDir
+		}
+		return tx.Bucket(BucketCertificate).Delete([]byte(serviceId))
+	})
+	certificates.Delete(serviceId)
+	return err
+}
+
+// fromCertDir reports whether a certificate is loaded from a file that is still there.
+func fromCertDir(meta CertificateMeta) bool {
+	if meta.Source == types.CertificateSourceAPI {
+		return false
+	}
+	_, err := os.Stat(meta.Source)
+	return err == nil
+}
+
+// serviceCertificate returns the certificate that TLS of users of a service is terminated with.
+func serviceCertificate(serviceId string) (*gotls.Certificate, error) {
+	if v, ok := certificates.Load(serviceId); ok {
+		return v.(*gotls.Certificate), nil
+	}
+	var meta CertificateMeta
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		meta, err = getCertificateMeta(tx, serviceId)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("no certificate for service %s, %v", serviceId, err)
+	}
+	pair, err := parseCertificate(meta.Cert, meta.Key)
+	if err != nil {
+		return nil, err
+	}
+	certificates.Store(serviceId, pair)
+	return pair, nil
+}
+
+// terminateTLS runs the server side of a TLS handshake on conn with the certificate of a service, and
+// returns the connection that plaintext of the user is read from.
+func terminateTLS(conn net.Conn, serviceId string) (net.Conn, error) {
+	tc := gotls.Server(conn, &gotls.Config{
+		GetCertificate: func(*gotls.ClientHelloInfo) (*gotls.Certificate, error) {
+			return serviceCertificate(serviceId)
+		},
+	})
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// certReloadInterval is how often the certificate directory is checked for changes
+const certReloadInterval = 10 * time.Second
+
+// watchCertDir loads certificates from dir whenever they change, so that renewing one does not require a
+// restart.
+func watchCertDir(dir string) {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		syncCertDir(dir)
+	}
+}
+
+// syncCertDir stores the certificates in dir, named <service id>.crt and <service id>.key, for their
+// services. Certificates loaded from dir before are deleted once their files are removed.
+func syncCertDir(dir string) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		log.Error("failed to list certificates in %s, %v", dir, err)
+		return
+	}
+	loaded := make(map[string]bool, len(files))
+	for _, certFile := range files {
+		serviceId := strings.TrimSuffix(filepath.Base(certFile), ".crt")
+		loaded[serviceId] = true
+		if err := loadCertFile(serviceId, certFile); err != nil {
+			log.Error("failed to load certificate %s, %v", certFile, err)
+		}
+	}
+
+	var stale []string
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketCertificate).ForEach(func(k, v []byte) error {
+			var meta CertificateMeta
+			if json.Unmarshal(v, &meta) == nil && filepath.Dir(meta.Source) == filepath.Clean(dir) &&
+				!loaded[string(k)] {
+				stale = append(stale, string(k))
+			}
+			return nil
+		})
+	})
+	for _, serviceId := range stale {
+		log.Info("certificate of service %s is removed from %s, deleting it", serviceId, dir)
+		if err := deleteCertificate(serviceId, true); err != nil {
+			log.Error("failed to delete certificate of service %s, %v", serviceId, err)
+		}
+	}
+}
+
+// loadCertFile stores certFile and the key next to it for a service, unless they are stored already.
+func loadCertFile(serviceId, certFile string) error {
+	keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+	cert, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	meta := CertificateMeta{Cert: string(cert), Key: string(key), Source: certFile}
+	var old CertificateMeta
+	db.View(func(tx *bolt.Tx) error {
+		old, _ = getCertificateMeta(tx, serviceId)
+		return nil
+	})
+	if old == meta {
+		return nil
+	}
+	if _, err := putCertificate(serviceId, meta); err != nil {
+		if err == ErrNotFound {
+			// the service may be created later
+			log.Debug("no service %s for certificate %s", serviceId, certFile)
+			return nil
+		}
+		return err
+	}
+	log.Info("loaded certificate of service %s from %s", serviceId, certFile)
+	return nil
+}
+
+// checkCertDir reports whether dir is a directory, so that a mistyped one fails at startup.
+func checkCertDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	gotls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vicxqh/srp/types"
+)
+
+// testCertificate returns a self-signed PEM certificate for name, and its key.
+func testCertificate(t *testing.T, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+}
+
+func TestCertificate(t *testing.T) {
+	require := require.New(t)
+	useTestDB(t)
+	require.NoError(createService(context.Background(), types.Service{ID: "wiki", Addr: "10.0.0.1:80"}))
+
+	cert, key := testCertificate(t, "wiki.example.com")
+	_, err := putCertificate("blog", CertificateMeta{Cert: cert, Key: key, Source: types.CertificateSourceAPI})
+	require.Equal(ErrNotFound, err)
+	_, err = putCertificate("wiki", CertificateMeta{Cert: cert, Key: "", Source: types.CertificateSourceAPI})
+	require.Error(err)
+	info, err := putCertificate("wiki", CertificateMeta{Cert: cert, Key: key, Source: types.CertificateSourceAPI})
+	require.NoError(err)
+	require.Equal([]string{"wiki.example.com"}, info.DNSNames)
+	svc, err := getService(context.Background(), "wiki")
+	require.NoError(err)
+	require.Equal(info, svc.Certificate)
+
+	// users are served with the certificate
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(cert))
+	user, conn := net.Pipe()
+	go func() {
+		tc := gotls.Client(user, &gotls.Config{ServerName: "wiki.example.com", RootCAs: pool})
+		tc.Write([]byte("hello"))
+		tc.Close()
+	}()
+	tc, err := terminateTLS(conn, "wiki")
+	require.NoError(err)
+	data, err := ioutil.ReadAll(tc)
+	require.NoError(err)
+	require.Equal("hello", string(data))
+
+	// a renewed certificate is used at once
+	cert, key = testCertificate(t, "wiki.example.com")
+	_, err = putCertificate("wiki", CertificateMeta{Cert: cert, Key: key, Source: types.CertificateSourceAPI})
+	require.NoError(err)
+	pair, err := serviceCertificate("wiki")
+	require.NoError(err)
+	block, _ := pem.Decode([]byte(cert))
+	require.Equal(block.Bytes, pair.Certificate[0])
+
+	require.NoError(deleteCertificate("wiki", false))
+	_, err = serviceCertificate("wiki")
+	require.Error(err)
+}
+
+func TestSyncCertDir(t *testing.T) {
+	require := require.New(t)
+	useTestDB(t)
+	require.NoError(createService(context.Background(), types.Service{ID: "wiki", Addr: "10.0.0.1:80"}))
+	dir, err := ioutil.TempDir("", "srp")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	cert, key := testCertificate(t, "wiki.example.com")
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "wiki.crt"), []byte(cert), 0600))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "wiki.key"), []byte(key), 0600))
+	// no such service
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "blog.crt"), []byte(cert), 0600))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "blog.key"), []byte(key), 0600))
+	syncCertDir(dir)
+
+	svc, err := getService(context.Background(), "wiki")
+	require.NoError(err)
+	require.Equal(filepath.Join(dir, "wiki.crt"), svc.Certificate.Source)
+	_, err = serviceCertificate("wiki")
+	require.NoError(err)
+
+	// the directory is not overridden through the api
+	_, err = putCertificate("wiki", CertificateMeta{Cert: cert, Key: key, Source: types.CertificateSourceAPI})
+	require.Equal(ErrCertificateFromDir, err)
+	require.Equal(ErrCertificateFromDir, deleteCertificate("wiki", false))
+
+	require.NoError(os.Remove(filepath.Join(dir, "wiki.crt")))
+	syncCertDir(dir)
+	_, err = serviceCertificate("wiki")
+	require.Error(err)
+}
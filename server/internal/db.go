@@ -5,27 +5,54 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/vicxqh/srp/log"
+	"github.com/vicxqh/srp/proto"
 	"github.com/vicxqh/srp/types"
 )
 
 var (
-	ErrNotFound     = errors.New("not found")
-	ErrAlreadyExist = errors.New("already existed")
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExist  = errors.New("already existed")
+	ErrHostnameTaken = errors.New("hostname is taken by another service")
 )
 
 var db *bolt.DB
 
 var (
 	BucketServiceMeta = []byte("service")
+	BucketAgentToken  = []byte("agent-token")
+	BucketAPIKey      = []byte("api-key")
+	BucketExposure    = []byte("exposure")
+	BucketCertificate = []byte("certificate")
 )
 
 type ServiceMeta struct {
 	ID          string // unique
 	Addr        string
 	Description string
+	Hostname    string `json:",omitempty"`
+	// DeclaredBy are the agents that declared the service, it is empty for services created by the api
+	DeclaredBy []string `json:",omitempty"`
+	// ProxyProtocol is the version of the PROXY protocol header sent to the service, none if empty
+	ProxyProtocol string `json:",omitempty"`
+}
+
+// ExposureMeta is what is stored for an exposure, keyed by service id.
+type ExposureMeta struct {
+	ServiceId string
+	AgentId   string `json:",omitempty"` // the only agent, of exposures stored before pools
+	Agents    []string
+	Balance   string
+	Bind      string `json:",omitempty"`
+	Port      string
+	TLS       bool   `json:",omitempty"`
+	Network   string `json:",omitempty"` // proto.NetworkTCP if empty
+	// IdleTimeout is how long users of a udp exposure may stay silent
+	IdleTimeout time.Duration `json:",omitempty"`
 }
 
 func InitDB() {
@@ -35,9 +62,12 @@ func InitDB() {
 		log.Fatal("failed to open db, %v", err)
 	}
 	db.Update(func(tx *bolt.Tx) error {
-		_, err = tx.CreateBucketIfNotExists(BucketServiceMeta)
-		if err != nil {
-			log.Fatal("failed to create bucket, %v", err)
+		for _, bucket := range [][]byte{BucketServiceMeta, BucketAgentToken, BucketAPIKey, BucketExposure,
+			BucketCertificate} {
+			_, err = tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				log.Fatal("failed to create bucket %s, %v", string(bucket), err)
+			}
 		}
 		return err
 	})
@@ -52,7 +82,7 @@ func listServices(ctx context.Context) ([]types.Service, error) {
 	err := db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(BucketServiceMeta)
 		return bucket.ForEach(func(k, v []byte) error {
-			s, err := composeService(v)
+			s, err := composeService(tx, v)
 			if err != nil {
 				log.Info("failed to compose service, %s, error %v", string(v), err)
 				return err
@@ -64,7 +94,7 @@ func listServices(ctx context.Context) ([]types.Service, error) {
 	return services, err
 }
 
-func composeService(metadata []byte) (types.Service, error) {
+func composeService(tx *bolt.Tx, metadata []byte) (types.Service, error) {
 	var s types.Service
 	var meta ServiceMeta
 	err := json.Unmarshal(metadata, &meta)
@@ -76,11 +106,28 @@ func composeService(metadata []byte) (types.Service, error) {
 	s.ID = meta.ID
 	s.Addr = meta.Addr
 	s.Description = meta.Description
+	s.Hostname = meta.Hostname
+	s.ProxyProtocol = meta.ProxyProtocol
 
 	exp := GetExposure(s.ID)
 	if exp != nil {
-		s.ExposedBy = exp.AgentId
+		s.ExposedBy = strings.Join(exp.Agents, ",")
+		s.Balance = exp.Balance
+		s.Bind = exp.Bind
 		s.ServerPort = exp.Port
+		s.TLS = exp.TLS
+		s.Network = exp.Network
+		if exp.Network == proto.NetworkUDP {
+			s.IdleTimeout = exp.IdleTimeout.String()
+		}
+	} else {
+		// a declared service is ready to be exposed by the agents that declared it
+		s.ExposedBy = strings.Join(meta.DeclaredBy, ",")
+	}
+	if cert, err := getCertificateMeta(tx, s.ID); err == nil {
+		if s.Certificate, err = certificateInfo(cert); err != nil {
+			log.Error("invalid certificate of service %s, %v", s.ID, err)
+		}
 	}
 
 	return s, nil
@@ -96,7 +143,7 @@ func getService(ctx context.Context, id string) (types.Service, error) {
 			return ErrNotFound
 		}
 		var err error
-		service, err = composeService(meta)
+		service, err = composeService(tx, meta)
 		return err
 	})
 	return service, err
@@ -107,21 +154,35 @@ func updateService(ctx context.Context, id string, svc types.Service) error {
 		return errors.New("Service.ID can NOT be empty")
 	}
 	if id != svc.ID {
-		return fmt.Errorf("Service.ID(%s) didn't match requested id(%s), svc.ID, id")
+		return fmt.Errorf("Service.ID(%s) didn't match requested id(%s)", svc.ID, id)
 	}
 	meta := ServiceMeta{
-		ID:          svc.ID,
-		Addr:        svc.Addr,
-		Description: svc.Description,
+		ID:            svc.ID,
+		Addr:          svc.Addr,
+		Description:   svc.Description,
+		Hostname:      svc.Hostname,
+		ProxyProtocol: svc.ProxyProtocol,
 	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketServiceMeta)
+		if err := checkHostnameFree(bucket, meta); err != nil {
+			return err
+		}
+		var old ServiceMeta
+		if data := bucket.Get([]byte(id)); data != nil && json.Unmarshal(data, &old) == nil {
+			// the agents still offer the service
+			meta.DeclaredBy = old.DeclaredBy
+		}
+		return putService(bucket, meta)
+	})
+}
+
+func putService(bucket *bolt.Bucket, meta ServiceMeta) error {
 	metadata, err := json.Marshal(meta)
 	if err != nil {
 		return err
 	}
-	return db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(BucketServiceMeta)
-		return bucket.Put([]byte(id), metadata)
-	})
+	return bucket.Put([]byte(meta.ID), metadata)
 }
 
 func createService(ctx context.Context, svc types.Service) error {
@@ -129,9 +190,11 @@ func createService(ctx context.Context, svc types.Service) error {
 		return errors.New("Service.ID can NOT be empty")
 	}
 	meta := ServiceMeta{
-		ID:          svc.ID,
-		Addr:        svc.Addr,
-		Description: svc.Description,
+		ID:            svc.ID,
+		Addr:          svc.Addr,
+		Description:   svc.Description,
+		Hostname:      svc.Hostname,
+		ProxyProtocol: svc.ProxyProtocol,
 	}
 	metadata, err := json.Marshal(meta)
 	if err != nil {
@@ -144,13 +207,231 @@ func createService(ctx context.Context, svc types.Service) error {
 		if old != nil {
 			return ErrAlreadyExist
 		}
+		if err := checkHostnameFree(bucket, meta); err != nil {
+			return err
+		}
 		return bucket.Put([]byte(svc.ID), metadata)
 	})
 }
 
+// checkHostnameFree returns ErrHostnameTaken if a service other than meta has the hostname of meta.
+func checkHostnameFree(bucket *bolt.Bucket, meta ServiceMeta) error {
+	if meta.Hostname == "" {
+		return nil
+	}
+	id, err := serviceByHostname(bucket, meta.Hostname)
+	if err == nil && id != meta.ID {
+		return ErrHostnameTaken
+	}
+	return nil
+}
+
+// serviceByHostname returns the id of the service that requests for hostname are routed to.
+func serviceByHostname(bucket *bolt.Bucket, hostname string) (string, error) {
+	var id string
+	err := bucket.ForEach(func(k, v []byte) error {
+		var meta ServiceMeta
+		if err := json.Unmarshal(v, &meta); err == nil && meta.Hostname == hostname {
+			id = meta.ID
+		}
+		return nil
+	})
+	if err == nil && id == "" {
+		err = ErrNotFound
+	}
+	return id, err
+}
+
+// findServiceByHostname returns the id of the service that requests for hostname are routed to.
+func findServiceByHostname(hostname string) (string, error) {
+	var id string
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		id, err = serviceByHostname(tx.Bucket(BucketServiceMeta), hostname)
+		return err
+	})
+	return id, err
+}
+
 func deleteService(ctx context.Context, id string) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(BucketServiceMeta)
 		return bucket.Delete([]byte(id))
 	})
 }
+
+// declareServices records the services that an agent declared in its registration. A service is left
+// alone if it is defined otherwise, by the api or by agents with another address. The agent is dropped
+// from the services it no longer declares, and a service that no agent declares any more is deleted
+// unless it is exposed.
+func declareServices(agentId string, services []types.Service) error {
+	declared := make(map[string]types.Service, len(services))
+	for _, svc := range services {
+		declared[svc.ID] = svc
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketServiceMeta)
+		metas := make(map[string]ServiceMeta)
+		err := bucket.ForEach(func(k, v []byte) error {
+			var meta ServiceMeta
+			if err := json.Unmarshal(v, &meta); err == nil {
+				metas[string(k)] = meta
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for id, meta := range metas {
+			if _, ok := declared[id]; ok || !hasString(meta.DeclaredBy, agentId) {
+				continue
+			}
+			meta.DeclaredBy = withoutString(meta.DeclaredBy, agentId)
+			if len(meta.DeclaredBy) == 0 && GetExposure(id) == nil {
+				log.Info("service %s is no longer declared by any agent, deleting it", id)
+				if err := bucket.Delete([]byte(id)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := putService(bucket, meta); err != nil {
+				return err
+			}
+		}
+
+		for id, svc := range declared {
+			meta, ok := metas[id]
+			others := withoutString(meta.DeclaredBy, agentId)
+			switch {
+			case !ok:
+				log.Info("agent %s declared service %s at %s", agentId, id, svc.Addr)
+			case len(meta.DeclaredBy) == 0:
+				log.Warn("agent %s declared service %s, which is created by the api already, ignoring it",
+					agentId, id)
+				continue
+			case len(others) > 0 && meta.Addr != svc.Addr:
+				log.Warn("agent %s declared service %s at %s, other agents declared it at %s, ignoring it",
+					agentId, id, svc.Addr, meta.Addr)
+				continue
+			}
+			meta.ID = id
+			meta.Addr = svc.Addr
+			meta.Description = svc.Description
+			meta.DeclaredBy = append(others, agentId)
+			if err := putService(bucket, meta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutString returns a copy of list without s.
+func withoutString(list []string, s string) []string {
+	var rest []string
+	for _, v := range list {
+		if v != s {
+			rest = append(rest, v)
+		}
+	}
+	return rest
+}
+
+func listExposures() ([]ExposureMeta, error) {
+	var exps []ExposureMeta
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketExposure).ForEach(func(k, v []byte) error {
+			meta, err := decodeExposure(v)
+			if err != nil {
+				log.Error("failed to unmarshal exposure %s, %v", string(k), err)
+				return nil
+			}
+			exps = append(exps, meta)
+			return nil
+		})
+	})
+	return exps, err
+}
+
+// getExposureMeta returns the stored exposure of a service, or nil if there is none.
+func getExposureMeta(serviceId string) (*ExposureMeta, error) {
+	var meta *ExposureMeta
+	err := db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(BucketExposure).Get([]byte(serviceId))
+		if data == nil {
+			return nil
+		}
+		m, err := decodeExposure(data)
+		meta = &m
+		return err
+	})
+	return meta, err
+}
+
+// decodeExposure unmarshals a stored exposure, and fills in what exposures stored by older versions lack.
+func decodeExposure(data []byte) (ExposureMeta, error) {
+	var meta ExposureMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, err
+	}
+	if len(meta.Agents) == 0 && meta.AgentId != "" {
+		meta.Agents = []string{meta.AgentId}
+		meta.AgentId = ""
+	}
+	if meta.Balance == "" {
+		meta.Balance = BalanceRoundRobin
+	}
+	if meta.Network == "" {
+		meta.Network = proto.NetworkTCP
+	}
+	return meta, nil
+}
+
+// reservedPorts returns the ports of stored exposures, keyed by portKey and mapped to their services. They
+// are kept for the services across restarts, even if listening on them failed.
+func reservedPorts() (map[string]string, error) {
+	exps, err := listExposures()
+	if err != nil {
+		return nil, err
+	}
+	ports := make(map[string]string, len(exps))
+	for _, exp := range exps {
+		if exp.Port == "" {
+			// reached by hostname only
+			continue
+		}
+		ports[portKey(exp.Network, exp.Port)] = exp.ServiceId
+	}
+	return ports, nil
+}
+
+// portKey tells tcp and udp ports of the same number apart.
+func portKey(network, port string) string {
+	return port + "/" + network
+}
+
+func saveExposure(meta ExposureMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketExposure).Put([]byte(meta.ServiceId), data)
+	})
+}
+
+func deleteExposure(serviceId string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketExposure).Delete([]byte(serviceId))
+	})
+}
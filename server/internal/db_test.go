@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+	"github.com/vicxqh/srp/log"
+	"github.com/vicxqh/srp/types"
+)
+
+// useTestDB points db to an empty database in a temporary directory.
+func useTestDB(t *testing.T) {
+	// the log is not set up in tests
+	log.SetLevel(log.LevelFatal)
+	dir, err := ioutil.TempDir("", "srp")
+	require.NoError(t, err)
+	db, err = bolt.Open(filepath.Join(dir, "service.db"), 0600, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{BucketServiceMeta, BucketAgentToken, BucketAPIKey, BucketExposure,
+			BucketCertificate} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+func TestDeclareServices(t *testing.T) {
+	require := require.New(t)
+	useTestDB(t)
+	ctx := context.Background()
+
+	require.NoError(createService(ctx, types.Service{ID: "api", Addr: "10.0.0.1:80"}))
+	require.NoError(declareServices("a1", []types.Service{
+		{ID: "web", Addr: "127.0.0.1:80", Description: "intranet web"},
+		{ID: "api", Addr: "127.0.0.1:8080"},
+	}))
+	web, err := getService(ctx, "web")
+	require.NoError(err)
+	require.Equal(types.Service{ID: "web", Addr: "127.0.0.1:80", Description: "intranet web", ExposedBy: "a1"}, web)
+	// services created by the api are left alone
+	api, err := getService(ctx, "api")
+	require.NoError(err)
+	require.Equal(types.Service{ID: "api", Addr: "10.0.0.1:80"}, api)
+
+	// agents declaring the same service form a pool, unless they disagree on the address
+	require.NoError(declareServices("a2", []types.Service{{ID: "web", Addr: "127.0.0.1:80"}}))
+	require.NoError(declareServices("a3", []types.Service{{ID: "web", Addr: "127.0.0.1:81"}}))
+	web, err = getService(ctx, "web")
+	require.NoError(err)
+	require.Equal("a1,a2", web.ExposedBy)
+
+	// an operator may update a declared service, the agents still offer it
+	require.NoError(updateService(ctx, "web", types.Service{ID: "web", Addr: "127.0.0.1:80", Description: "web"}))
+	web, err = getService(ctx, "web")
+	require.NoError(err)
+	require.Equal("a1,a2", web.ExposedBy)
+
+	// a service is deleted once no agent declares it
+	require.NoError(declareServices("a1", nil))
+	require.NoError(declareServices("a2", nil))
+	_, err = getService(ctx, "web")
+	require.Equal(ErrNotFound, err)
+	_, err = getService(ctx, "api")
+	require.NoError(err)
+}
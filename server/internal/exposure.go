@@ -2,66 +2,296 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/vicxqh/srp/transport"
 
 	"github.com/vicxqh/srp/log"
 	"github.com/vicxqh/srp/proto"
+	"github.com/vicxqh/srp/types"
 )
 
 var exposures sync.Map
 
 type Exposure struct {
 	ServiceId string
-	AgentId   string
-	Port      string
+	Agents    []string // the pool of agents that users are spread over
+	Balance   string
+	Bind      string // the address or interface that users connect to, all interfaces if empty
+	Port      string // empty if users reach the service by its hostname only
+	TLS       bool   // TLS of users is terminated with the certificate of the service
+	Network   string // proto.NetworkTCP or proto.NetworkUDP
+	next      uint32 // the next agent of round-robin
 	lis       net.Listener
 	ctx       context.Context
 	cancel    context.CancelFunc
+
+	// IdleTimeout is how long a user of a udp exposure may stay silent before its stream ends
+	IdleTimeout time.Duration
+	pc          net.PacketConn // listened on instead of lis by udp exposures
+	users       sync.Map       // datagram users of a udp exposure, keyed by their addresses
 }
 
 func (exp *Exposure) ServeUsers() {
 	for {
 		conn, err := exp.lis.Accept()
 		if err != nil {
+			if exp.ctx.Err() != nil {
+				// stopped
+				return
+			}
 			log.Error("exposure %s failed to accept, %v", exp.ServiceId, err)
 			continue
 		}
-		go exp.handleUserConnection(conn)
+		go exp.acceptUser(conn)
+	}
+}
+
+// acceptUser serves a user that connected to the exposure directly, rather than through the http front
+// end. TLS is terminated first if the exposure asks for it.
+func (exp *Exposure) acceptUser(conn net.Conn) {
+	if exp.TLS {
+		tc, err := terminateTLS(conn, exp.ServiceId)
+		if err != nil {
+			log.Warn("failed to terminate TLS of user %s of service %s, %v", conn.RemoteAddr(), exp.ServiceId, err)
+			conn.Close()
+			return
+		}
+		conn = tc
 	}
+	exp.handleUserConnection(conn)
 }
 
-var users sync.Map
+// streams holds every user connection and datagram user, keyed by stream id
+var streams sync.Map
+
+// lastStreamId is the id assigned to the latest stream
+var lastStreamId uint32
 
-func ForwardToUser(segment transport.Segment) error {
+// addStream registers a user connection or a datagram user in streams, and returns the id assigned to it.
+func addStream(user interface{}) uint32 {
+	for {
+		id := atomic.AddUint32(&lastStreamId, 1)
+		// 0 is never used, so that an unset id can be told apart. After the counter wraps around,
+		// ids of long-lived streams are still in use and must be skipped.
+		if id == 0 {
+			continue
+		}
+		if _, loaded := streams.LoadOrStore(id, user); !loaded {
+			return id
+		}
+	}
+}
+
+// ForwardToUser forwards a segment received on session s to the user of its stream.
+func ForwardToUser(s *session, segment transport.Segment) error {
 	header := segment.Header
-	log.Debug("service(%s) -> user(%s) : %d bytes", header.Service(), header.User(), header.PayloadLength())
+	log.Debug("service -> stream(%d) : %s %d bytes", header.Stream(), header.Type(), header.PayloadLength())
 
-	cv, ok := users.Load(header.User())
+	cv, ok := streams.Load(header.Stream())
 	if !ok {
-		err := fmt.Errorf("no connection for user %s", header.User())
-		log.Error("%v", err)
-		return err
+		switch header.Type() {
+		case proto.TypeClose, proto.TypeReset, proto.TypeWindowUpdate:
+			// the user has gone already, the agent is still granting credit or closing its side
+			return nil
+		}
+		// the agent sent data before it learned that the stream is closed, make sure it does learn
+		log.Debug("no connection for stream %d, resetting it", header.Stream())
+		resetStream(s, header.Stream())
+		return nil
+	}
+	if du, ok := cv.(*datagramUser); ok {
+		return du.forward(s, segment)
 	}
 	uc := cv.(*userConnection)
-	return uc.sendToUser(segment.Payload)
+	if uc.getSession() != s {
+		// ids are easy to guess, an agent must not touch streams of other agents
+		return fmt.Errorf("agent %s sent %s segment of stream %d which does not belong to the session",
+			s.agent.ID, header.Type(), header.Stream())
+	}
+	switch header.Type() {
+	case proto.TypeData:
+		if err := uc.sendToUser(segment.Payload); err != nil {
+			log.Error("failed to queue data of stream %d, %v", uc.stream, err)
+			uc.closeStream(proto.TypeReset)
+			uc.cancel()
+			return err
+		}
+		return nil
+	case proto.TypeWindowUpdate:
+		increment, err := transport.WindowIncrement(segment)
+		if err != nil {
+			return err
+		}
+		uc.window.Release(int(increment))
+		return nil
+	case proto.TypeClose:
+		// a nil data tells SendLoop to half-close the user after pending data is flushed, the user may still
+		// send to the service
+		return uc.sendToUser(nil)
+	case proto.TypeReset:
+		if len(segment.Payload) > 0 {
+			log.Warn("agent %s reset stream %d of user %s, %s", s.agent.ID, uc.stream, uc.user, segment.Payload)
+		}
+		uc.closeOnce.Do(func() {})
+		uc.cancel()
+		return nil
+	}
+	return fmt.Errorf("unexpected %s segment of stream %d from service %s", header.Type(), header.Stream(),
+		uc.service)
+}
+
+// resetStreams tears down the streams opened on session s, after the session ended.
+func resetStreams(s *session) {
+	streams.Range(func(key, value interface{}) bool {
+		switch user := value.(type) {
+		case *userConnection:
+			if user.getSession() == s {
+				user.closeOnce.Do(func() {})
+				user.cancel()
+			}
+		case *datagramUser:
+			if user.getSession() == s {
+				user.closeOnce.Do(func() {})
+				user.cancel()
+			}
+		}
+		return true
+	})
+}
+
+// resetStream tells the agent to tear down the service connection of a stream that has no user any more.
+func resetStream(s *session, stream uint32) {
+	if err := s.Send(transport.Segment{Header: proto.NewHeader(proto.TypeReset, stream)}); err != nil {
+		log.Error("failed to reset stream %d on agent %s, %v", stream, s.agent.ID, err)
+	}
 }
 
 type userConnection struct {
-	ctx      context.Context
-	cancel   context.CancelFunc
-	exposure *Exposure
-	user     string
-	sendChan chan []byte
-	conn     net.Conn
+	ctx       context.Context
+	cancel    context.CancelFunc
+	exposure  *Exposure
+	sessionMu sync.Mutex
+	session   *session // the session of an agent that the stream is opened on
+	stream    uint32
+	user      string
+	service   string
+	window    *transport.Window // credit for sending to the agent
+	sendQueue *transport.Queue  // data from the agent, waiting to be written to the user
+	conn      net.Conn
+	closeOnce sync.Once // makes sure the agent is told about the end of the stream only once
+	ended     int32     // how many directions of the stream have ended, it is torn down once both have
+
+	proxyProtocol int // version of the PROXY protocol header that the agent sends to the service, 0 for none
 }
 
+// sendToUser queues data for the user, it never blocks, so a slow user can not hold up the agent link.
 func (uc *userConnection) sendToUser(data []byte) error {
-	uc.sendChan <- data
-	return nil
+	return uc.sendQueue.Push(data)
+}
+
+// closeStream tells the agent that the user side of the stream has ended, unless the agent ended it first.
+func (uc *userConnection) closeStream(typ proto.Type) {
+	uc.closeOnce.Do(func() {
+		header := proto.NewHeader(typ, uc.stream)
+		if err := uc.session.Send(transport.Segment{Header: header}); err != nil {
+			log.Error("failed to send %s of stream %d to agent, %v", typ, uc.stream, err)
+		}
+	})
+}
+
+// endDirection tears down the stream once both the user and the service have closed their sides.
+func (uc *userConnection) endDirection() {
+	if atomic.AddInt32(&uc.ended, 1) == 2 {
+		uc.cancel()
+	}
+}
+
+// closeWriter is a connection able to close its sending side only, like *net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func (uc *userConnection) setSession(s *session) {
+	uc.sessionMu.Lock()
+	uc.session = s
+	uc.sessionMu.Unlock()
+}
+
+func (uc *userConnection) getSession() *session {
+	uc.sessionMu.Lock()
+	defer uc.sessionMu.Unlock()
+	return uc.session
+}
+
+// open asks an agent of the exposure to connect to the service for this user.
+func (uc *userConnection) open() error {
+	header, err := proto.NewOpenHeader(uc.stream, uc.user, uc.service)
+	if err != nil {
+		return err
+	}
+	header.SetProxyProtocol(uc.proxyProtocol)
+	return uc.exposure.openStream(header, uc.user, uc.setSession)
+}
+
+// proxyProtocolVersion returns the version of the PROXY protocol named by setting, a setting of a service.
+func proxyProtocolVersion(setting string) (int, error) {
+	switch setting {
+	case "":
+		return 0, nil
+	case types.ProxyProtocolV1:
+		return 1, nil
+	case types.ProxyProtocolV2:
+		return 2, nil
+	}
+	return 0, fmt.Errorf("unknown PROXY protocol %s, expected %s or %s", setting, types.ProxyProtocolV1,
+		types.ProxyProtocolV2)
+}
+
+// openStream sends header, which opens a stream of user, to an agent of the exposure. Agents that are
+// gone are skipped, agents whose links dropped are tried only if no agent is connected. The stream is
+// opened on the session of the agent that carries the fewest streams, setSession is told about the
+// session before the stream is opened on it.
+func (exp *Exposure) openStream(header proto.Header, user string, setSession func(*session)) error {
+	var connected, detached []*agent
+	for _, id := range exp.order(user) {
+		a := getAgent(id)
+		switch {
+		case a == nil:
+		case header.Network() == proto.NetworkUDP && !a.datagrams:
+			log.Warn("agent %s is of an older version, which does not forward udp", a.ID)
+		case header.ProxyProtocol() != 0 && !a.proxyProtocol:
+			log.Warn("agent %s is of an older version, which does not send PROXY protocol headers", a.ID)
+		case a.attached():
+			connected = append(connected, a)
+		default:
+			detached = append(detached, a)
+		}
+	}
+	err := fmt.Errorf("no agent of %v is connected", exp.Agents)
+	for _, a := range append(connected, detached...) {
+		s := a.pick()
+		if s == nil {
+			continue
+		}
+		// the session must be known before any segment of the stream arrives
+		setSession(s)
+		if err = s.Send(transport.Segment{Header: header}); err != nil {
+			log.Warn("failed to open stream %d on agent %s, %v", header.Stream(), a.ID, err)
+			continue
+		}
+		s.countStream(1)
+		return nil
+	}
+	setSession(nil)
+	return err
 }
 
 func (uc *userConnection) Stop() {
@@ -71,43 +301,79 @@ func (uc *userConnection) Stop() {
 
 func (uc *userConnection) SendLoop() {
 	for {
-		select {
-		case <-uc.ctx.Done():
+		data, err := uc.sendQueue.Pop(uc.ctx)
+		if err != nil {
 			return
-		case data := <-uc.sendChan:
-			_, err := uc.conn.Write(data)
-			if err != nil {
-				log.Error("failed to write to user %s, %v", uc.user, err)
+		}
+		if data == nil {
+			log.Info("service closed the stream of user %s", uc.user)
+			if cw, ok := uc.conn.(closeWriter); ok && cw.CloseWrite() == nil {
+				uc.endDirection()
+			} else {
 				uc.cancel()
-				return
+			}
+			return
+		}
+		if _, err := uc.conn.Write(data); err != nil {
+			log.Error("failed to write to user %s, %v", uc.user, err)
+			uc.closeStream(proto.TypeReset)
+			uc.cancel()
+			return
+		}
+		if n := uc.sendQueue.Consume(len(data)); n > 0 {
+			if err := uc.session.Send(transport.NewWindowUpdate(uc.stream, uint32(n))); err != nil {
+				log.Error("failed to update window of stream %d, %v", uc.stream, err)
 			}
 		}
 	}
 }
 
 func (uc *userConnection) RecvLoop() {
-	defer uc.cancel()
+	halfClosed := false
+	defer func() {
+		if halfClosed {
+			// the user may still read what the service sends
+			uc.endDirection()
+		} else {
+			uc.cancel()
+		}
+	}()
 	for {
 		select {
 		case <-uc.ctx.Done():
 			return
 		default:
-			buffer := make([]byte, 1024)
+			// never read more than the agent is able to take
+			credit, err := uc.window.Acquire(uc.ctx, 1024)
+			if err != nil {
+				return
+			}
+			buffer := make([]byte, credit)
 			n, err := uc.conn.Read(buffer)
+			uc.window.Release(credit - n)
+			if err == io.EOF {
+				log.Info("user %s closed the connection", uc.user)
+				uc.closeStream(proto.TypeClose)
+				halfClosed = true
+				return
+			}
+			if err != nil && uc.ctx.Err() != nil {
+				// closed by this side
+				return
+			}
 			if err != nil {
 				log.Error("failed to read from user %s, %v", uc.user, err)
+				uc.closeStream(proto.TypeReset)
 				return
 			}
 			data := buffer[:n]
 			log.Debug("received %d bytes from users %s", len(data), uc.user)
-			svc, err := getService(uc.ctx, uc.exposure.ServiceId)
-			if err != nil {
-				log.Error("failed to get service, %v. service might get updated", err)
+			header := proto.NewHeader(proto.TypeData, uc.stream)
+			header.SetPayloadLength(uint32(len(data)))
+			if err := uc.session.Send(transport.Segment{Header: header, Payload: data}); err != nil {
+				log.Error("failed to send to agent %s, %v", uc.session.agent.ID, err)
 				return
 			}
-			header, _ := proto.NewHeader(uc.user, svc.Addr)
-			header.SetPayloadLength(uint32(len(data)))
-			SendToAgent(uc.exposure.AgentId, transport.Segment{header, data})
 		}
 	}
 }
@@ -117,67 +383,222 @@ func (exp *Exposure) handleUserConnection(conn net.Conn) {
 	log.Info("new user connection from %s", user)
 
 	ctx, cancel := context.WithCancel(context.Background())
+	svc, err := getService(ctx, exp.ServiceId)
+	if err != nil {
+		log.Error("failed to get service, %v. service might get updated", err)
+		cancel()
+		conn.Close()
+		return
+	}
 	uc := &userConnection{
-		ctx:      ctx,
-		cancel:   cancel,
-		exposure: exp,
-		user:     conn.RemoteAddr().String(),
-		sendChan: make(chan []byte, 1),
-		conn:     conn,
+		ctx:       ctx,
+		cancel:    cancel,
+		exposure:  exp,
+		user:      user,
+		service:   svc.Addr,
+		window:    transport.NewWindow(proto.InitialWindowSize),
+		sendQueue: transport.NewQueue(proto.InitialWindowSize),
+		conn:      conn,
 	}
-	users.Store(user, uc)
+	// the version is checked when the service is saved
+	uc.proxyProtocol, _ = proxyProtocolVersion(svc.ProxyProtocol)
+	uc.stream = addStream(uc)
 
-	go uc.SendLoop()
-	go uc.RecvLoop()
+	if err := uc.open(); err != nil {
+		log.Error("failed to open stream %d for user %s, %v", uc.stream, user, err)
+		// the agent knows nothing about this stream, no need to reset it
+		uc.closeOnce.Do(func() {})
+		uc.cancel()
+	} else {
+		go uc.SendLoop()
+		go uc.RecvLoop()
+	}
 
 	<-uc.ctx.Done()
-	users.Delete(user)
-	log.Info("removed user connection %s", user)
+	uc.closeStream(proto.TypeReset)
+	if uc.session != nil {
+		uc.session.countStream(-1)
+	}
+	streams.Delete(uc.stream)
+	log.Info("removed user connection %s, stream %d", user, uc.stream)
 	uc.Stop()
 }
 
 func (exp *Exposure) Stop() {
 	exp.cancel()
-	exp.lis.Close()
+	if exp.lis != nil {
+		exp.lis.Close()
+	}
+	if exp.pc != nil {
+		exp.pc.Close()
+	}
 }
 
-func NewExposure(serviceId, agentId, port string) error {
-	if old, ok := exposures.Load(serviceId); ok {
-		oe := old.(*Exposure)
-		oe.Stop()
+// ErrPortInUse is returned for a port that is listened on, or reserved by the exposure of another service.
+var ErrPortInUse = errors.New("port is in use")
+
+// exposeMu serializes new exposures, so that no two of them reserve the same port
+var exposeMu sync.Mutex
+
+// NewExposure exposes a service on a port through a pool of agents, and stores it so that it survives
+// restarts. Users are spread over the agents by the balance of meta.
+func NewExposure(meta ExposureMeta) error {
+	exposeMu.Lock()
+	defer exposeMu.Unlock()
+	return newExposure(meta)
+}
+
+func newExposure(meta ExposureMeta) error {
+	if len(meta.Agents) == 0 {
+		return errors.New("at least one agent is required")
+	}
+	if err := checkBalance(meta.Balance); err != nil {
+		return err
+	}
+	if _, err := listenHost(meta.Bind); err != nil {
+		return err
+	}
+	if meta.Network == "" {
+		meta.Network = proto.NetworkTCP
+	}
+	switch meta.Network {
+	case proto.NetworkTCP:
+	case proto.NetworkUDP:
+		if meta.Port == "" || meta.TLS {
+			return errors.New("udp requires a port, and can not terminate tls")
+		}
+		if meta.IdleTimeout <= 0 {
+			return errors.New("udp requires an idle timeout")
+		}
+	default:
+		return fmt.Errorf("unknown network %s, expected %s or %s", meta.Network, proto.NetworkTCP, proto.NetworkUDP)
+	}
+	if meta.TLS {
+		if _, err := serviceCertificate(meta.ServiceId); err != nil {
+			return err
+		}
+	}
+	reserved, err := reservedPorts()
+	if err != nil {
+		return err
+	}
+	if id, ok := reserved[portKey(meta.Network, meta.Port)]; ok && id != meta.ServiceId {
+		log.Error("%s port %s is reserved by the exposure of service %s", meta.Network, meta.Port, id)
+		return ErrPortInUse
+	}
+	previous, err := getExposureMeta(meta.ServiceId)
+	if err != nil {
+		return err
+	}
+	if err := startExposure(meta); err != nil {
+		return err
+	}
+	if err := saveExposure(meta); err != nil {
+		log.Error("failed to save exposure of service %s, %v", meta.ServiceId, err)
+		stopExposure(meta.ServiceId)
+		if previous != nil {
+			// the stored exposure is the one that survives restarts, it goes on serving users
+			if err := startExposure(*previous); err != nil {
+				log.Error("failed to restore exposure of service %s, %v", meta.ServiceId, err)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// RestoreExposures starts listening for every stored exposure. Users are served as soon as the agents
+// of the exposures connect.
+func RestoreExposures() {
+	exps, err := listExposures()
+	if err != nil {
+		log.Error("failed to load exposures, %v", err)
+		return
+	}
+	for _, meta := range exps {
+		if err := startExposure(meta); err != nil {
+			log.Error("failed to restore exposure of service %s on port %s, %v", meta.ServiceId, meta.Port, err)
+			continue
+		}
+		log.Info("restored exposure of service %s by agents %v on port %s", meta.ServiceId, meta.Agents, meta.Port)
+	}
+}
+
+func startExposure(meta ExposureMeta) error {
+	old := GetExposure(meta.ServiceId)
+	if old != nil && old.Port == meta.Port && old.Network == meta.Network {
+		// the port is handed over to the new exposure
+		old.Stop()
 	}
 
 	var err error
 	ctx, cancel := context.WithCancel(context.Background())
-	_, err = getService(ctx, serviceId)
+	_, err = getService(ctx, meta.ServiceId)
 	if err != nil {
+		cancel()
 		return err
 	}
 	e := &Exposure{
-		ServiceId: serviceId,
-		AgentId:   agentId,
-		Port:      port,
+		ServiceId: meta.ServiceId,
+		Agents:    meta.Agents,
+		Balance:   meta.Balance,
+		Bind:      meta.Bind,
+		Port:      meta.Port,
+		TLS:       meta.TLS,
+		Network:   meta.Network,
 		ctx:       ctx,
 		cancel:    cancel,
-	}
 
-	if e.lis, err = net.Listen("tcp4", ":"+port); err != nil {
-		log.Error("failed to listen on port %s, %v", port, err)
+		IdleTimeout: meta.IdleTimeout,
+	}
+	host, err := listenHost(meta.Bind)
+	if err != nil {
+		cancel()
 		return err
 	}
+	if meta.Port != "" {
+		addr := net.JoinHostPort(host, meta.Port)
+		if meta.Network == proto.NetworkUDP {
+			e.pc, err = net.ListenPacket("udp", addr)
+		} else {
+			e.lis, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			log.Error("failed to listen on %s %s, %v", meta.Network, addr, err)
+			cancel()
+			if errors.Is(err, syscall.EADDRINUSE) {
+				return ErrPortInUse
+			}
+			return err
+		}
+	}
+	if old != nil && (old.Port != meta.Port || old.Network != meta.Network) {
+		// users move to the new port only once it is listened on
+		old.Stop()
+	}
 	log.Info("exposed. %+v", e)
-	exposures.Store(serviceId, e)
-	go e.ServeUsers()
+	exposures.Store(meta.ServiceId, e)
+	if e.lis != nil {
+		go e.ServeUsers()
+	}
+	if e.pc != nil {
+		go e.ServeDatagrams()
+	}
 	return nil
 }
 
 func DeleteExposure(serviceId string) error {
+	stopExposure(serviceId)
+	return deleteExposure(serviceId)
+}
+
+// stopExposure stops serving users of a service, the stored exposure is kept.
+func stopExposure(serviceId string) {
 	if old, ok := exposures.Load(serviceId); ok {
 		oe := old.(*Exposure)
 		oe.Stop()
 	}
 	exposures.Delete(serviceId)
-	return nil
 }
 
 func GetExposure(serviceId string) *Exposure {
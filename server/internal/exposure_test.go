@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+	"github.com/vicxqh/srp/proto"
+	"github.com/vicxqh/srp/transport"
+	"github.com/vicxqh/srp/types"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	require := require.New(t)
+	useTestDB(t)
+	ctx := context.Background()
+	require.NoError(createService(ctx, types.Service{ID: "web", Addr: "10.0.0.80:80",
+		ProxyProtocol: types.ProxyProtocolV2}))
+	svc, err := getService(ctx, "web")
+	require.NoError(err)
+	require.Equal(types.ProxyProtocolV2, svc.ProxyProtocol)
+	_, err = proxyProtocolVersion("v3")
+	require.Error(err)
+
+	old, oldSessions := newTestAgent(t, "old", 1)
+	defer old.end()
+	a, ss := newTestAgent(t, "new", 1)
+	defer a.end()
+	a.proxyProtocol = true
+	require.NoError(NewExposure(ExposureMeta{ServiceId: "web", Agents: []string{"old", "new"},
+		Balance: BalanceRoundRobin, Bind: "127.0.0.1", Port: "0"}))
+	defer DeleteExposure("web")
+
+	// agents unable to send PROXY protocol headers are skipped
+	for i := 0; i < 2; i++ {
+		user, err := net.Dial("tcp", GetExposure("web").lis.Addr().String())
+		require.NoError(err)
+		defer user.Close()
+		select {
+		case open := <-ss[0].sendChan:
+			require.Equal(proto.TypeOpen, open.Header.Type())
+			require.Equal(2, open.Header.ProxyProtocol())
+			require.Equal(user.LocalAddr().String(), open.Header.User())
+		case <-time.After(time.Second):
+			require.Fail("stream is not opened")
+		}
+	}
+	require.Empty(oldSessions[0].sendChan)
+}
+
+func TestHalfClose(t *testing.T) {
+	require := require.New(t)
+	useTestDB(t)
+	require.NoError(createService(context.Background(), types.Service{ID: "web", Addr: "10.0.0.80:80"}))
+	a, ss := newTestAgent(t, "half", 1)
+	defer a.end()
+	require.NoError(NewExposure(ExposureMeta{ServiceId: "web", Agents: []string{"half"},
+		Balance: BalanceRoundRobin, Bind: "127.0.0.1", Port: "0"}))
+	defer DeleteExposure("web")
+
+	conn, err := net.Dial("tcp", GetExposure("web").lis.Addr().String())
+	require.NoError(err)
+	defer conn.Close()
+	user := conn.(*net.TCPConn)
+	_, err = user.Write([]byte("request"))
+	require.NoError(err)
+	require.NoError(user.CloseWrite())
+
+	receive := func() transport.Segment {
+		select {
+		case segment := <-ss[0].sendChan:
+			return segment
+		case <-time.After(time.Second):
+			require.Fail("nothing is sent to the agent")
+		}
+		return transport.Segment{}
+	}
+	open := receive()
+	require.Equal(proto.TypeOpen, open.Header.Type())
+	data := receive()
+	require.Equal(proto.TypeData, data.Header.Type())
+	require.Equal("request", string(data.Payload))
+	require.Equal(proto.TypeClose, receive().Header.Type())
+
+	// the user is still able to read the response after it closed its side
+	stream := open.Header.Stream()
+	header := proto.NewHeader(proto.TypeData, stream)
+	header.SetPayloadLength(8)
+	require.NoError(ForwardToUser(ss[0], transport.Segment{Header: header, Payload: []byte("response")}))
+	_, ok := streams.Load(stream)
+	require.True(ok)
+	require.NoError(ForwardToUser(ss[0], transport.Segment{Header: proto.NewHeader(proto.TypeClose, stream)}))
+	user.SetReadDeadline(time.Now().Add(time.Second))
+	response, err := ioutil.ReadAll(user)
+	require.NoError(err)
+	require.Equal("response", string(response))
+
+	// the stream ends once both sides are closed, the agent is not reset
+	require.Eventually(func() bool {
+		_, ok := streams.Load(stream)
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	require.Empty(ss[0].sendChan)
+}
+
+func TestRestoreExposures(t *testing.T) {
+	require := require.New(t)
+	useTestDB(t)
+	ctx := context.Background()
+	require.NoError(createService(ctx, types.Service{ID: "web", Addr: "10.0.0.80:80"}))
+	require.NoError(createService(ctx, types.Service{ID: "dns", Addr: "10.0.0.53:53"}))
+
+	require.NoError(saveExposure(ExposureMeta{ServiceId: "dns", Agents: []string{"a1", "a2"}, Balance: BalanceHash,
+		Bind: "127.0.0.1", Port: "0", Network: proto.NetworkUDP, IdleTimeout: time.Minute}))
+	// stored by an older version, before pools, balances and udp
+	require.NoError(db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketExposure).Put([]byte("web"), []byte(`{"ServiceId":"web","AgentId":"a1","Port":"0"}`))
+	}))
+	// the service has gone
+	require.NoError(saveExposure(ExposureMeta{ServiceId: "gone", Agents: []string{"a1"}, Port: "0"}))
+
+	exps, err := listExposures()
+	require.NoError(err)
+	require.Len(exps, 3)
+	web, err := getExposureMeta("web")
+	require.NoError(err)
+	require.Equal(ExposureMeta{ServiceId: "web", Agents: []string{"a1"}, Balance: BalanceRoundRobin, Port: "0",
+		Network: proto.NetworkTCP}, *web)
+	missing, err := getExposureMeta("missing")
+	require.NoError(err)
+	require.Nil(missing)
+
+	RestoreExposures()
+	defer stopExposure("web")
+	defer stopExposure("dns")
+	exp := GetExposure("web")
+	require.NotNil(exp)
+	require.NotNil(exp.lis)
+	require.Equal([]string{"a1"}, exp.Agents)
+	exp = GetExposure("dns")
+	require.NotNil(exp)
+	require.NotNil(exp.pc)
+	require.Equal(BalanceHash, exp.Balance)
+	require.Equal(time.Minute, exp.IdleTimeout)
+	require.Nil(GetExposure("gone"))
+	// it is still stored, the port stays reserved for the service
+	gone, err := getExposureMeta("gone")
+	require.NoError(err)
+	require.NotNil(gone)
+}
+
+func TestNewExposureNotSaved(t *testing.T) {
+	require := require.New(t)
+	useTestDB(t)
+	require.NoError(createService(context.Background(), types.Service{ID: "web", Addr: "10.0.0.80:80"}))
+	previous := ExposureMeta{ServiceId: "web", Agents: []string{"a1"}, Balance: BalanceRoundRobin,
+		Bind: "127.0.0.1", Port: "0", Network: proto.NetworkTCP}
+	require.NoError(NewExposure(previous))
+	defer DeleteExposure("web")
+
+	// the db fails to save the new exposure
+	path := db.Path()
+	require.NoError(db.Close())
+	var err error
+	db, err = bolt.Open(path, 0600, &bolt.Options{ReadOnly: true})
+	require.NoError(err)
+	require.Error(NewExposure(ExposureMeta{ServiceId: "web", Agents: []string{"a1", "a2"}, Balance: BalanceHash,
+		Bind: "127.0.0.1", Port: "0"}))
+
+	// the stored exposure is kept, and serves users
+	stored, err := getExposureMeta("web")
+	require.NoError(err)
+	require.Equal(previous, *stored)
+	exp := GetExposure("web")
+	require.NotNil(exp)
+	require.Equal(previous.Agents, exp.Agents)
+	require.Equal(BalanceRoundRobin, exp.Balance)
+	conn, err := net.Dial("tcp", exp.lis.Addr().String())
+	require.NoError(err)
+	conn.Close()
+}
+
+func TestAddStream(t *testing.T) {
+	require := require.New(t)
+
+	atomic.StoreUint32(&lastStreamId, math.MaxUint32-1)
+	// a long-lived stream, opened before the ids wrapped around
+	streams.Store(uint32(1), "long-lived")
+	defer streams.Delete(uint32(1))
+
+	id := addStream("a")
+	require.Equal(uint32(math.MaxUint32), id)
+	defer streams.Delete(id)
+	// 0 is never used, and 1 is still in use
+	id = addStream("b")
+	require.Equal(uint32(2), id)
+	defer streams.Delete(id)
+	v, _ := streams.Load(uint32(1))
+	require.Equal("long-lived", v)
+}
+
+func TestForwardToUserOwner(t *testing.T) {
+	require := require.New(t)
+	owner, ownerSessions := newTestAgent(t, "owner", 1)
+	defer owner.end()
+	other, otherSessions := newTestAgent(t, "other", 1)
+	defer other.end()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	uc := &userConnection{ctx: ctx, cancel: cancel, session: ownerSessions[0],
+		sendQueue: transport.NewQueue(proto.InitialWindowSize)}
+	uc.stream = addStream(uc)
+	defer streams.Delete(uc.stream)
+	header := proto.NewHeader(proto.TypeData, uc.stream)
+	header.SetPayloadLength(4)
+	data := transport.Segment{Header: header, Payload: []byte("data")}
+
+	// stream ids are easy to guess, an agent must not touch streams of others
+	require.Error(ForwardToUser(otherSessions[0], data))
+	reset := transport.Segment{Header: proto.NewHeader(proto.TypeReset, uc.stream)}
+	require.Error(ForwardToUser(otherSessions[0], reset))
+	require.NoError(ctx.Err())
+
+	require.NoError(ForwardToUser(ownerSessions[0], data))
+	queued, err := uc.sendQueue.Pop(ctx)
+	require.NoError(err)
+	require.Equal("data", string(queued))
+
+	// so are datagram users
+	du := &datagramUser{ctx: ctx, cancel: cancel, session: ownerSessions[0]}
+	du.stream = addStream(du)
+	defer streams.Delete(du.stream)
+	closed := transport.Segment{Header: proto.NewHeader(proto.TypeClose, du.stream)}
+	require.Error(ForwardToUser(otherSessions[0], closed))
+	require.NoError(ctx.Err())
+}
@@ -2,14 +2,17 @@ package internal
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/vicxqh/srp/transport/plain"
-
+	"github.com/vicxqh/srp/proto"
 	"github.com/vicxqh/srp/transport"
 
 	"github.com/vicxqh/srp/log"
@@ -18,12 +21,52 @@ import (
 
 var agents sync.Map
 
-func addAgent(agent *agent) error {
+// agentsMu serializes registrations, which check and replace entries of agents
+var agentsMu sync.Mutex
+
+// policies for an agent that registers while another one of the same ID is connected
+const (
+	// DuplicateReject rejects the new agent.
+	DuplicateReject = "reject"
+	// DuplicateTakeover drops the connected agent in favor of the new one, if the new one proved that it
+	// is the agent, by a client certificate or a token. It is rejected otherwise.
+	DuplicateTakeover = "takeover"
+	// DuplicateSuffix registers the new agent under the ID with a suffix, like agent-2.
+	DuplicateSuffix = "suffix"
+)
+
+// addAgent registers the new session of an agent, authenticated tells whether the new agent proved who it
+// is. A detached session of the same agent is ended if so, it is never resumed after the agent started over.
+// Otherwise the registered agent, connected or not, is handled by policy, so that an agent whose link
+// dropped is not pushed out by anyone claiming its ID. It is still replaced once its session is not resumed
+// in time.
+func addAgent(agent *agent, policy string, authenticated bool) error {
 	if agent.ID == "" {
-		return errors.New("agent id is required")
+		return permanentError{errors.New("agent id is required")}
 	}
-	if _, ok := agents.Load(agent.ID); ok {
-		return ErrAlreadyExist
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+	if old := getAgent(agent.ID); old != nil {
+		switch {
+		case !old.attached() && authenticated:
+			log.Info("agent %s started a new session, ending the detached one", agent.ID)
+		case policy == DuplicateTakeover && authenticated:
+			log.Warn("agent %s is taken over by a new connection", agent.ID)
+		case policy == DuplicateTakeover:
+			return fmt.Errorf("agent %s is registered, taking it over requires a token or a client certificate",
+				agent.ID)
+		case policy == DuplicateSuffix:
+			for i := 2; getAgent(agent.ID) != nil; i++ {
+				agent.ID = fmt.Sprintf("%s-%d", agent.name, i)
+			}
+			log.Info("agent %s is registered, registering the new one as %s", agent.name, agent.ID)
+			old = nil
+		default:
+			return ErrAlreadyExist
+		}
+		if old != nil {
+			go old.end()
+		}
 	}
 	agents.Store(agent.ID, agent)
 	return nil
@@ -33,8 +76,20 @@ func removeAgent(agent *agent) {
 	if agent == nil {
 		return
 	}
-	log.Info("removing agent %s", agent.ID)
-	agents.Delete(agent.ID)
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+	if v, ok := agents.Load(agent.ID); ok && v == agent {
+		log.Info("removing agent %s", agent.ID)
+		agents.Delete(agent.ID)
+	}
+}
+
+func getAgent(id string) *agent {
+	v, ok := agents.Load(id)
+	if !ok {
+		return nil
+	}
+	return v.(*agent)
 }
 
 func listAgents() []types.Agent {
@@ -47,63 +102,390 @@ func listAgents() []types.Agent {
 	return tagents
 }
 
-func SendToAgent(agentId string, segment transport.Segment) error {
-	agentV, ok := agents.Load(agentId)
-	if !ok {
-		return fmt.Errorf("agent %s not found", agentId)
-	}
-	agent := agentV.(*agent)
-	return agent.Send(segment)
-}
-
+// agent is a registered agent. It may pool several links to the server, each link carries a session of
+// its own, and streams are spread over the sessions.
 type agent struct {
 	types.Agent
-	conn     transport.Transport
-	ctx      context.Context
+	name    string          // the ID that the agent registered with, Agent.ID may have a suffix
+	pool    string          // presented by links joining the pool, empty if the agent can not pool links
+	ctx     context.Context // done when the agent is removed
+	cancel  context.CancelFunc
+	grace   time.Duration // how long a detached session waits to be resumed
+	streams int32         // how many streams are open on the agent
+	endOnce sync.Once
+	// datagrams tells whether the agent is able to forward udp
+	datagrams bool
+	// proxyProtocol tells whether the agent is able to send PROXY protocol headers to services
+	proxyProtocol bool
+
+	mu       sync.Mutex
+	sessions []*session
+}
+
+// session carries some of the streams of an agent. It is carried by one link at a time, and outlives a
+// dropped link for a grace period, so that the agent is able to resume it on a new link without breaking
+// streams.
+type session struct {
+	*transport.Session
+	agent    *agent
+	ctx      context.Context // done when the session ends
 	cancel   context.CancelFunc
 	sendChan chan transport.Segment
+	sendMu   sync.Mutex // held by the sendLoop of the current link
+	streams  int32      // how many streams are open on the session
+	endOnce  sync.Once
+
+	mu    sync.Mutex
+	link  *link       // nil while detached
+	timer *time.Timer // ends the detached session unless it is resumed in time
+}
+
+// link is a connection carrying a session of an agent.
+type link struct {
+	conn      transport.Transport
+	ctx       context.Context
+	cancel    context.CancelFunc
+	heartbeat *transport.Heartbeat
+	control   chan transport.Segment // link segments, sent ahead of the segments of the session
+
+	mu     sync.Mutex
+	closed bool // nothing received on the link counts once it is closed
 }
 
-func (a *agent) Send(segment transport.Segment) error {
-	a.sendChan <- segment
+// sendControl queues a segment that is meaningful on link l only. It never blocks, so that the receive loop
+// is not held up by a send loop writing to a busy link. The segment is dropped if the queue is full, the
+// segments sent instead prove that the link is alive, and a later ACK covers the segments of a dropped one.
+func (l *link) sendControl(segment transport.Segment) error {
+	if l.ctx.Err() != nil {
+		return errors.New("link has dropped")
+	}
+	select {
+	case l.control <- segment:
+	default:
+		log.Debug("dropped a %s segment, the link falls behind", segment.Header.Type())
+	}
 	return nil
 }
 
-func (a *agent) sendLoop() {
+// stop drops the link. Segments it is still sending are replayed on the next link.
+func (l *link) stop() {
+	l.cancel()
+	l.conn.Conn().Close()
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+}
+
+func (a *agent) countStream(delta int32) {
+	atomic.AddInt32(&a.streams, delta)
+}
+
+func (a *agent) streamCount() int {
+	return int(atomic.LoadInt32(&a.streams))
+}
+
+// attached tells whether any session of the agent is carried by a link.
+func (a *agent) attached() bool {
+	for _, s := range a.list() {
+		if s.attached() {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the sessions of the agent.
+func (a *agent) list() []*session {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*session(nil), a.sessions...)
+}
+
+// pick returns the session that a new stream is opened on, the attached one with the fewest streams, or
+// a detached one if none is attached. It returns nil if the agent has no session.
+func (a *agent) pick() *session {
+	var picked *session
+	for _, s := range a.list() {
+		switch {
+		case picked == nil:
+			picked = s
+		case s.attached() != picked.attached():
+			if s.attached() {
+				picked = s
+			}
+		case s.streamCount() < picked.streamCount():
+			picked = s
+		}
+	}
+	return picked
+}
+
+// newSession adds a session to the agent.
+func (a *agent) newSession(resumable bool) (*session, error) {
+	ts, err := transport.NewSession(resumable)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(a.ctx)
+	s := &session{
+		Session:  ts,
+		agent:    a,
+		ctx:      ctx,
+		cancel:   cancel,
+		sendChan: make(chan transport.Segment, 1),
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.ctx.Err() != nil {
+		cancel()
+		return nil, fmt.Errorf("agent %s has gone", a.ID)
+	}
+	a.sessions = append(a.sessions, s)
+	return s, nil
+}
+
+// removeSession removes an ended session. The agent is done once its last session is removed, and it is
+// told by the returned value.
+func (a *agent) removeSession(s *session) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, v := range a.sessions {
+		if v == s {
+			a.sessions = append(a.sessions[:i], a.sessions[i+1:]...)
+			break
+		}
+	}
+	if len(a.sessions) == 0 {
+		// no link joins an agent that is about to be removed
+		a.cancel()
+		return true
+	}
+	return false
+}
+
+// end removes the agent, all of its sessions end.
+func (a *agent) end() {
+	a.endOnce.Do(func() {
+		a.cancel()
+		removeAgent(a)
+	})
+	for _, s := range a.list() {
+		s.end()
+	}
+}
+
+func (s *session) Send(segment transport.Segment) error {
+	select {
+	case s.sendChan <- segment:
+		return nil
+	case <-s.ctx.Done():
+		return fmt.Errorf("session of agent %s has ended", s.agent.ID)
+	}
+}
+
+// countStream counts streams of both the session and its agent.
+func (s *session) countStream(delta int32) {
+	atomic.AddInt32(&s.streams, delta)
+	s.agent.countStream(delta)
+}
+
+func (s *session) streamCount() int {
+	return int(atomic.LoadInt32(&s.streams))
+}
+
+func (s *session) attached() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.link != nil
+}
+
+// attach makes l the link of the session, the previous link is dropped.
+func (s *session) attach(l *link) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() != nil {
+		return errors.New("session has ended")
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if s.link != nil {
+		s.link.stop()
+	}
+	s.link = l
+	return nil
+}
+
+// detach is called after l dropped. Unless the session has moved to another link, it ends after the
+// grace period, or right away if it can not be resumed.
+func (s *session) detach(l *link) {
+	s.mu.Lock()
+	if s.link != l {
+		s.mu.Unlock()
+		return
+	}
+	s.link = nil
+	grace := s.agent.grace
+	if s.ID == "" || grace <= 0 || s.ctx.Err() != nil {
+		s.mu.Unlock()
+		s.end()
+		return
+	}
+	log.Info("link of agent %s dropped, waiting %v for the session to be resumed", s.agent.ID, grace)
+	s.timer = time.AfterFunc(grace, func() {
+		s.mu.Lock()
+		resumed := s.link != nil
+		if !resumed {
+			s.cancel()
+		}
+		s.mu.Unlock()
+		if !resumed {
+			log.Info("session of agent %s is not resumed in time", s.agent.ID)
+			s.end()
+		}
+	})
+	s.mu.Unlock()
+}
+
+// end ends the session, its streams are torn down. The agent is removed with its last session.
+func (s *session) end() {
+	s.mu.Lock()
+	s.cancel()
+	l := s.link
+	s.mu.Unlock()
+	if l != nil {
+		l.cancel()
+	}
+	s.endOnce.Do(func() {
+		resetStreams(s)
+		if s.agent.removeSession(s) {
+			s.agent.end()
+		}
+	})
+}
+
+// serve carries the session on l until l drops.
+func (s *session) serve(l *link) {
+	go s.sendLoop(l)
+	go s.recvLoop(l)
+	if l.heartbeat.Interval > 0 {
+		go s.keepAlive(l)
+	}
+	select {
+	case <-l.ctx.Done():
+	case <-s.ctx.Done():
+	}
+	l.stop()
+}
+
+func (s *session) sendLoop(l *link) {
+	// the previous link must be done with sending before segments it missed are replayed
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if l.ctx.Err() != nil {
+		return
+	}
+	send := func(data transport.Segment) bool {
+		log.Debug("stream(%d) -> agent(%s) : %s %d bytes", data.Header.Stream(), s.agent.ID, data.Header.Type(),
+			data.Header.PayloadLength())
+		if err := l.conn.Send(data); err != nil {
+			l.cancel()
+			return false
+		}
+		return true
+	}
+	for _, data := range s.Unacked() {
+		if !send(data) {
+			return
+		}
+	}
 	for {
+		// link segments go first, a PONG must not wait behind a window of data
 		select {
-		case <-a.ctx.Done():
+		case data := <-l.control:
+			if !send(data) {
+				return
+			}
+			continue
+		default:
+		}
+		select {
+		case <-l.ctx.Done():
 			return
-		case data := <-a.sendChan:
-			log.Debug("user(%s) -> service(%s) : %d bytes", data.Header.User(), data.Header.Service(),
-				data.Header.PayloadLength())
-			if err := a.conn.Send(data); err != nil {
-				a.cancel()
+		case data := <-l.control:
+			if !send(data) {
+				return
+			}
+		case data := <-s.sendChan:
+			s.Sent(data)
+			if !send(data) {
 				return
 			}
 		}
 	}
 }
 
-func (a *agent) recvLoop() {
+func (s *session) recvLoop(l *link) {
 	for {
-		select {
-		case <-a.ctx.Done():
+		data, err := l.conn.Receive()
+		if err != nil {
+			if l.ctx.Err() == nil {
+				log.Error("failed to receive from agent %s, %v", s.agent.ID, err)
+			}
+			l.cancel()
 			return
-		default:
-			data, err := a.conn.Receive()
+		}
+		l.mu.Lock()
+		if l.closed {
+			// the session has moved to another link, the agent replays the segment there
+			l.mu.Unlock()
+			return
+		}
+		received := s.Received(data)
+		l.mu.Unlock()
+
+		l.heartbeat.Seen()
+		switch data.Header.Type() {
+		case proto.TypePing:
+			l.sendControl(transport.NewPong())
+			continue
+		case proto.TypePong:
+			continue
+		case proto.TypeAck:
+			n, err := transport.AckCount(data)
+			if err == nil {
+				err = s.Ack(n)
+			}
 			if err != nil {
-				log.Error("failed to receive from agent %s, %v", a.ID, err)
-				a.cancel()
+				log.Error("bad ack from agent %s, %v", s.agent.ID, err)
+				l.cancel()
 				return
 			}
-			ForwardToUser(data)
+			continue
+		}
+		if s.ID != "" && received%transport.AckEvery == 0 {
+			l.sendControl(transport.NewAck(received))
+		}
+		if err := ForwardToUser(s, data); err != nil {
+			log.Error("failed to forward to user, %v", err)
 		}
 	}
 }
 
+// keepAlive drops the link once it is found dead.
+func (s *session) keepAlive(l *link) {
+	err := l.heartbeat.Run(l.ctx, func() error {
+		return l.sendControl(transport.NewPing())
+	})
+	if err != nil {
+		log.Error("link of agent %s is dead, %v", s.agent.ID, err)
+		l.cancel()
+	}
+}
+
 func (s *Server) AcceptAgents() {
-	l, err := net.Listen("tcp4", fmt.Sprintf(":%d", s.DataPort()))
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", s.DataPort()))
 	if err != nil {
 		log.Fatal("failed to listen on data port, %v", err)
 	}
@@ -121,56 +503,248 @@ func (s *Server) handleAgentConnection(conn net.Conn) {
 	defer conn.Close()
 	log.Info("new agent connection from %s", conn.RemoteAddr().String())
 
-	// registration handshake
-	buffer := make([]byte, 1024)
-	n, err := conn.Read(buffer)
+	t, err := s.newTransport(conn)
 	if err != nil {
-		log.Error("failed to read registration, %v", err)
+		log.Error("failed to set up %s transport with %s, %v", s.config.Transport, conn.RemoteAddr().String(), err)
 		return
 	}
-	buffer = buffer[:n]
-	log.Info("agent meta: %s", string(buffer))
+	// closing the transport connection lets tls tell the agent with a close_notify
+	defer t.Conn().Close()
 
-	var agentMeta types.Agent
-	if err := json.Unmarshal(buffer, &agentMeta); err != nil {
-		log.Error("illegal agent format, %s, %v", string(buffer), err)
+	// registration handshake
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	var req types.AgentRegistrationRequest
+	if err := transport.ReceiveHandshake(t, &req); err != nil {
+		// the payload is not logged, it may contain a token
+		log.Error("failed to read registration from %s, the agent may be of an older version, %v",
+			conn.RemoteAddr().String(), err)
 		return
 	}
-
-	// register agent
-	ctx, cancel := context.WithCancel(context.Background())
-	agent := &agent{
-		Agent:    agentMeta,
-		conn:     plain.NewConnection(conn),
-		ctx:      ctx,
-		cancel:   cancel,
-		sendChan: make(chan transport.Segment, 1),
+	agentMeta := req.Agent
+	log.Info("agent meta: %+v, protocol version %d, capabilities %v", agentMeta, req.Version, req.Capabilities)
+	version, err := negotiateVersion(req.Version)
+	if err != nil {
+		log.Error("agent %s from %s is incompatible, %v", agentMeta.ID, conn.RemoteAddr().String(), err)
+		replyRegistration(t, types.AgentRegistrationResponse{}, err)
+		return
 	}
-	if err := addAgent(agent); err != nil {
-		log.Error("failed to add agent", err)
-		rsp := types.AgentRegistrationResponse{
-			Succeeded: false,
-			Message:   err.Error(),
-		}
-		rspData, _ := json.Marshal(rsp)
-		conn.Write(rspData)
+	capabilities := proto.Negotiate(proto.Capabilities, req.Capabilities)
+	authenticated, err := s.verifyAgent(t, req)
+	if err != nil {
+		log.Error("failed to verify agent %s from %s, %v", agentMeta.ID, conn.RemoteAddr().String(), err)
+		replyRegistration(t, types.AgentRegistrationResponse{Version: version, Capabilities: capabilities}, err)
 		return
 	}
 
-	defer removeAgent(agent)
-
 	rsp := types.AgentRegistrationResponse{
-		Succeeded: true,
-		Message:   "OK",
+		Version:      version,
+		Capabilities: capabilities,
 	}
-	rspData, _ := json.Marshal(rsp)
-	if _, err := conn.Write(rspData); err != nil {
+	lctx, lcancel := context.WithCancel(context.Background())
+	defer lcancel()
+	l := &link{
+		conn:   t,
+		ctx:    lctx,
+		cancel: lcancel,
+		heartbeat: &transport.Heartbeat{
+			Timeout: s.config.HeartbeatTimeout,
+		},
+		control: make(chan transport.Segment, transport.ControlQueueSize),
+	}
+	if proto.HasCapability(capabilities, proto.CapHeartbeat) {
+		l.heartbeat.Interval = s.config.HeartbeatInterval
+	}
+
+	session := s.resumeSession(req, l)
+	if session != nil {
+		rsp.Resumed = true
+		rsp.Received = session.ReceivedCount()
+		log.Info("agent %s resumed its session, %d segments received", agentMeta.ID, rsp.Received)
+	} else {
+		resumable := proto.HasCapability(capabilities, proto.CapResume) && s.config.ResumeGrace > 0
+		if session, err = s.joinPool(req, resumable); err == nil && session == nil {
+			pooled := proto.HasCapability(capabilities, proto.CapPool) && s.config.MaxAgentConnections > 1
+			session, err = s.newAgent(req, resumable, pooled, authenticated)
+		}
+		if err == nil {
+			err = session.attach(l)
+		}
+		if err != nil {
+			log.Error("failed to add agent %s, %v", agentMeta.ID, err)
+			replyRegistration(t, rsp, err)
+			return
+		}
+	}
+	defer session.detach(l)
+	rsp.Session = session.ID
+	rsp.AgentID = session.agent.ID
+	rsp.Pool = session.agent.pool
+
+	if err := replyRegistration(t, rsp, nil); err != nil {
 		log.Error("failed to write registration response to agent, %v", err)
 		return
 	}
+	conn.SetDeadline(time.Time{})
+
+	session.serve(l)
+}
+
+// resumeSession moves the session requested by an agent to link l. It returns nil if there is no such
+// session to resume.
+func (s *Server) resumeSession(req types.AgentRegistrationRequest, l *link) *session {
+	if req.Session == "" {
+		return nil
+	}
+	session := findSession(req.ID, req.Session)
+	if session == nil {
+		log.Info("session of agent %s is gone, starting a new one", req.ID)
+		return nil
+	}
+	if err := session.Ack(req.Received); err != nil {
+		log.Error("session of agent %s is broken, %v", req.ID, err)
+		session.end()
+		return nil
+	}
+	if err := session.attach(l); err != nil {
+		log.Info("session of agent %s can not be resumed, %v", req.ID, err)
+		return nil
+	}
+	return session
+}
+
+// findSession returns the session of id of the agent registered by name, or nil if there is none.
+func findSession(name, id string) *session {
+	var found *session
+	agents.Range(func(key, value interface{}) bool {
+		a := value.(*agent)
+		if a.name != name {
+			return true
+		}
+		for _, s := range a.list() {
+			if s.ID != "" && subtle.ConstantTimeCompare([]byte(s.ID), []byte(id)) == 1 {
+				found = s
+				return false
+			}
+		}
+		return true
+	})
+	return found
+}
 
-	go agent.sendLoop()
-	go agent.recvLoop()
+// findPool returns the agent registered by name with pool id, or nil if there is none.
+func findPool(name, id string) *agent {
+	var found *agent
+	agents.Range(func(key, value interface{}) bool {
+		a := value.(*agent)
+		if a.name == name && a.pool != "" && subtle.ConstantTimeCompare([]byte(a.pool), []byte(id)) == 1 {
+			found = a
+			return false
+		}
+		return true
+	})
+	return found
+}
 
-	<-agent.ctx.Done()
+// joinPool adds a session to the agent whose pool of links is requested. It returns nil if the agent
+// requests no pool, or the pool is gone and the agent is to be registered again.
+func (s *Server) joinPool(req types.AgentRegistrationRequest, resumable bool) (*session, error) {
+	if req.Pool == "" && !req.Join {
+		return nil, nil
+	}
+	a := findPool(req.ID, req.Pool)
+	if a == nil && req.Join {
+		return nil, fmt.Errorf("pool of agent %s is gone", req.ID)
+	}
+	if a == nil {
+		log.Info("pool of agent %s is gone, registering the agent again", req.ID)
+		return nil, nil
+	}
+	if n := len(a.list()); n >= s.config.MaxAgentConnections {
+		return nil, permanentError{fmt.Errorf("agent %s has %d connections, no more than %d are allowed",
+			a.ID, n, s.config.MaxAgentConnections)}
+	}
+	session, err := a.newSession(resumable)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("a new connection of agent %s joined its pool, %d connections", a.ID, len(a.list()))
+	return session, nil
+}
+
+// newAgent registers an agent with its first session, pooled tells whether more links may join it.
+func (s *Server) newAgent(req types.AgentRegistrationRequest, resumable, pooled, authenticated bool) (*session, error) {
+	if err := checkServices(req.Services); err != nil {
+		return nil, permanentError{err}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &agent{
+		Agent:  req.Agent,
+		name:   req.ID,
+		ctx:    ctx,
+		cancel: cancel,
+		grace:  s.config.ResumeGrace,
+
+		datagrams:     proto.HasCapability(req.Capabilities, proto.CapDatagram),
+		proxyProtocol: proto.HasCapability(req.Capabilities, proto.CapProxyProtocol),
+	}
+	if pooled {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			cancel()
+			return nil, err
+		}
+		a.pool = hex.EncodeToString(b)
+	}
+	session, err := a.newSession(resumable)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := addAgent(a, s.config.DuplicateAgent, authenticated); err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := declareServices(a.ID, req.Services); err != nil {
+		log.Error("failed to record services declared by agent %s, %v", a.ID, err)
+	}
+	return session, nil
+}
+
+// checkServices validates the services declared by an agent.
+func checkServices(services []types.Service) error {
+	ids := make(map[string]bool, len(services))
+	for _, svc := range services {
+		if svc.ID == "" || svc.Addr == "" {
+			return fmt.Errorf("declared service %q needs an ID and an Addr", svc.ID)
+		}
+		if ids[svc.ID] {
+			return fmt.Errorf("service %s is declared twice", svc.ID)
+		}
+		ids[svc.ID] = true
+	}
+	return nil
+}
+
+// negotiateVersion returns the protocol version to speak with an agent that speaks up to version.
+func negotiateVersion(version int) (int, error) {
+	if version < proto.MinVersion {
+		return 0, permanentError{fmt.Errorf("agent speaks protocol version %d, server speaks %d to %d, upgrade the agent",
+			version, proto.MinVersion, proto.Version)}
+	}
+	if version > proto.Version {
+		return proto.Version, nil
+	}
+	return version, nil
+}
+
+// replyRegistration tells the agent whether it is registered, err is the reason if it is not.
+func replyRegistration(t transport.Transport, rsp types.AgentRegistrationResponse, err error) error {
+	rsp.Succeeded = true
+	rsp.Message = "OK"
+	if err != nil {
+		rsp.Succeeded = false
+		rsp.Message = err.Error()
+		_, rsp.Permanent = err.(permanentError)
+	}
+	return transport.SendHandshake(t, rsp)
 }
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vicxqh/srp/log"
+	"github.com/vicxqh/srp/proto"
+	"github.com/vicxqh/srp/transport"
+	"github.com/vicxqh/srp/types"
+)
+
+func newTestAgent(t *testing.T, id string, sessions int) (*agent, []*session) {
+	// the log is not set up in tests
+	log.SetLevel(log.LevelFatal)
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &agent{Agent: types.Agent{ID: id}, name: id, ctx: ctx, cancel: cancel}
+	var ss []*session
+	for i := 0; i < sessions; i++ {
+		s, err := a.newSession(false)
+		require.NoError(t, err)
+		ss = append(ss, s)
+	}
+	require.NoError(t, addAgent(a, DuplicateReject, false))
+	return a, ss
+}
+
+func newTestLink() *link {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &link{ctx: ctx, cancel: cancel, control: make(chan transport.Segment, transport.ControlQueueSize)}
+}
+
+func TestPick(t *testing.T) {
+	require := require.New(t)
+
+	a, ss := newTestAgent(t, "pick", 3)
+	defer a.end()
+
+	// detached sessions are picked only if none is attached
+	require.Equal(ss[0], a.pick())
+	ss[1].link = newTestLink()
+	ss[2].link = newTestLink()
+	require.Equal(ss[1], a.pick())
+
+	ss[1].countStream(2)
+	ss[2].countStream(1)
+	require.Equal(ss[2], a.pick())
+	require.Equal(3, a.streamCount())
+}
+
+func TestEndSession(t *testing.T) {
+	require := require.New(t)
+
+	a, ss := newTestAgent(t, "end", 2)
+	ss[0].end()
+	require.Equal([]*session{ss[1]}, a.list())
+	require.Equal(a, getAgent("end"))
+
+	// the agent is removed with its last session
+	ss[1].end()
+	require.Nil(getAgent("end"))
+	require.Error(a.ctx.Err())
+	_, err := a.newSession(false)
+	require.Error(err)
+}
+
+func TestSendControl(t *testing.T) {
+	require := require.New(t)
+
+	// nobody sends on the link, as if its send loop were stuck writing to a busy connection
+	l := newTestLink()
+	for i := 0; i < 2*transport.ControlQueueSize; i++ {
+		require.NoError(l.sendControl(transport.NewPong()))
+	}
+	require.Len(l.control, transport.ControlQueueSize)
+	require.Equal(proto.TypePong, (<-l.control).Header.Type())
+
+	l.cancel()
+	require.Error(l.sendControl(transport.NewPong()))
+}
+
+func TestAddAgent(t *testing.T) {
+	require := require.New(t)
+	// the log is not set up in tests
+	log.SetLevel(log.LevelFatal)
+	newAgent := func(id string) *agent {
+		ctx, cancel := context.WithCancel(context.Background())
+		return &agent{Agent: types.Agent{ID: id}, name: id, ctx: ctx, cancel: cancel}
+	}
+	ended := func(a *agent) func() bool {
+		return func() bool { return a.ctx.Err() != nil }
+	}
+
+	old, ss := newTestAgent(t, "dup", 1)
+	defer func() { getAgent("dup").end() }()
+	ss[0].link = newTestLink()
+
+	// a connected agent is handled by policy
+	require.Equal(ErrAlreadyExist, addAgent(newAgent("dup"), DuplicateReject, true))
+	require.Error(addAgent(newAgent("dup"), DuplicateTakeover, false))
+	require.Equal(old, getAgent("dup"))
+
+	suffixed := newAgent("dup")
+	require.NoError(addAgent(suffixed, DuplicateSuffix, false))
+	require.Equal("dup-2", suffixed.ID)
+	defer suffixed.end()
+	another := newAgent("dup")
+	require.NoError(addAgent(another, DuplicateSuffix, false))
+	require.Equal("dup-3", another.ID)
+	defer another.end()
+	require.Equal(old, getAgent("dup"))
+
+	takeover := newAgent("dup")
+	require.NoError(addAgent(takeover, DuplicateTakeover, true))
+	require.Equal(takeover, getAgent("dup"))
+	require.Eventually(ended(old), time.Second, 10*time.Millisecond)
+
+	// so is an agent whose link dropped, unless the new one proved who it is
+	s, err := takeover.newSession(true)
+	require.NoError(err)
+	require.False(s.attached())
+	for _, policy := range []string{DuplicateReject, DuplicateTakeover} {
+		require.Error(addAgent(newAgent("dup"), policy, false), policy)
+		require.Equal(takeover, getAgent("dup"))
+	}
+	suffixed = newAgent("dup")
+	require.NoError(addAgent(suffixed, DuplicateSuffix, false))
+	require.Equal("dup-4", suffixed.ID)
+	defer suffixed.end()
+
+	restarted := newAgent("dup")
+	require.NoError(addAgent(restarted, DuplicateReject, true))
+	require.Equal(restarted, getAgent("dup"))
+	require.Eventually(ended(takeover), time.Second, 10*time.Millisecond)
+
+	require.Error(addAgent(newAgent(""), DuplicateSuffix, true))
+}
@@ -4,7 +4,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/vicxqh/srp/proto"
 	"github.com/vicxqh/srp/types"
 
 	"github.com/vicxqh/srp/log"
@@ -64,6 +68,16 @@ func (s *Server) UpdateService(c *gin.Context) {
 		log.Info("received http body: %s", string(data))
 		return
 	}
+	if svc.Hostname != "" {
+		if svc.Hostname, err = checkHostname(svc.Hostname); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if _, err := proxyProtocolVersion(svc.ProxyProtocol); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
 	err = updateService(c, id, svc)
 	if err != nil {
 		log.Error("failed to update service, %v", err)
@@ -71,6 +85,10 @@ func (s *Server) UpdateService(c *gin.Context) {
 			c.String(http.StatusBadRequest, "not found")
 			return
 		}
+		if err == ErrHostnameTaken {
+			c.String(http.StatusConflict, "hostname %s is taken by another service", svc.Hostname)
+			return
+		}
 		c.Status(http.StatusInternalServerError)
 		return
 	}
@@ -92,6 +110,16 @@ func (s *Server) CreateService(c *gin.Context) {
 		log.Info("received http body: %s", string(data))
 		return
 	}
+	if svc.Hostname != "" {
+		if svc.Hostname, err = checkHostname(svc.Hostname); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if _, err := proxyProtocolVersion(svc.ProxyProtocol); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
 	err = createService(c, svc)
 	if err != nil {
 		log.Error("failed to create service, %v", err)
@@ -99,6 +127,10 @@ func (s *Server) CreateService(c *gin.Context) {
 			c.String(http.StatusBadRequest, "already existed")
 			return
 		}
+		if err == ErrHostnameTaken {
+			c.String(http.StatusConflict, "hostname %s is taken by another service", svc.Hostname)
+			return
+		}
 		c.Status(http.StatusInternalServerError)
 		return
 	}
@@ -121,13 +153,99 @@ func (s *Server) DeleteService(c *gin.Context) {
 		c.Status(http.StatusInternalServerError)
 		return
 	}
-	DeleteExposure(id)
+	if err := DeleteExposure(id); err != nil {
+		log.Error("failed to delete exposure of service %s, %v", id, err)
+	}
+	if err := deleteCertificate(id, true); err != nil && err != ErrNotFound {
+		log.Error("failed to delete certificate of service %s, %v", id, err)
+	}
+}
+
+func (s *Server) PutCertificate(c *gin.Context) {
+	id := c.Param("id")
+	var cert types.Certificate
+	if err := c.BindJSON(&cert); err != nil {
+		log.Error("failed to bind http body as an instance of Certificate, %v", err)
+		c.JSON(http.StatusBadRequest, "body should be a certificate")
+		return
+	}
+	meta := CertificateMeta{Cert: cert.Cert, Key: cert.Key, Source: types.CertificateSourceAPI}
+	info, err := putCertificate(id, meta)
+	if err != nil {
+		log.Error("failed to put certificate of service %s, %v", id, err)
+		switch err {
+		case ErrNotFound:
+			c.String(http.StatusNotFound, "not found")
+		case ErrCertificateFromDir:
+			c.String(http.StatusConflict, err.Error())
+		default:
+			c.String(http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+	log.Info("uploaded certificate of service %s for %v", id, info.DNSNames)
+	c.JSON(http.StatusOK, info)
+}
+
+func (s *Server) DeleteCertificate(c *gin.Context) {
+	id := c.Param("id")
+	if err := deleteCertificate(id, false); err != nil {
+		log.Error("failed to delete certificate of service %s, %v", id, err)
+		switch err {
+		case ErrNotFound:
+			c.String(http.StatusNotFound, "not found")
+		case ErrCertificateFromDir:
+			c.String(http.StatusConflict, err.Error())
+		default:
+			c.Status(http.StatusInternalServerError)
+		}
+		return
+	}
+	c.Status(http.StatusOK)
 }
 
 func (s *Server) ListAgents(c *gin.Context) {
 	c.JSON(http.StatusOK, listAgents())
 }
 
+func (s *Server) IssueAgentToken(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		log.Error("empty agent id")
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	token, err := issueAgentToken(id)
+	if err != nil {
+		log.Error("failed to issue token for agent %s, %v", id, err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	log.Info("issued a new token for agent %s", id)
+	c.JSON(http.StatusOK, types.AgentToken{AgentID: id, Token: token})
+}
+
+func (s *Server) RevokeAgentToken(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		log.Error("empty agent id")
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	err := revokeAgentToken(id)
+	if err != nil {
+		log.Error("failed to revoke token of agent %s, %v", id, err)
+		if err == ErrNotFound {
+			c.String(http.StatusNotFound, "not found")
+			return
+		}
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	log.Info("revoked token of agent %s", id)
+	c.Status(http.StatusOK)
+}
+
 func (s *Server) ExposeService(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
@@ -135,19 +253,114 @@ func (s *Server) ExposeService(c *gin.Context) {
 		c.Status(http.StatusBadRequest)
 		return
 	}
-	agentId := c.Query("agent")
+	agentIds := c.Query("agent")
 	port := c.Query("port")
-	if agentId == "" || port == "" {
-		c.String(http.StatusBadRequest, "required parameters in query: agent, port")
+	svc, err := getService(c, id)
+	if err != nil {
+		log.Error("failed to get service %s, %v", id, err)
+		if err == ErrNotFound {
+			c.String(http.StatusNotFound, "not found")
+			return
+		}
+		c.Status(http.StatusInternalServerError)
 		return
 	}
-	err := NewExposure(id, agentId, port)
+	if agentIds == "" {
+		// a service declared by agents is exposed by them, unless told otherwise
+		agentIds = svc.ExposedBy
+	}
+	if agentIds == "" {
+		c.String(http.StatusBadRequest, "required parameter in query: agent, unless the service is declared by agents")
+		return
+	}
+	network := c.DefaultQuery("network", proto.NetworkTCP)
+	if network != proto.NetworkTCP && network != proto.NetworkUDP {
+		c.String(http.StatusBadRequest, "unknown network %s, expected %s or %s", network, proto.NetworkTCP,
+			proto.NetworkUDP)
+		return
+	}
+	// a service with a hostname given no port is reached through the front ends only
+	byHostname := port == "" && svc.Hostname != "" && s.vhosts() && network == proto.NetworkTCP
+	if port == "" && !byHostname && s.ports.empty() {
+		c.String(http.StatusBadRequest, "required parameter in query: port, "+
+			"unless the service has a hostname or a port range is configured to allocate it")
+		return
+	}
+	// a pool of agents is separated by commas
+	var agents []string
+	for _, agentId := range strings.Split(agentIds, ",") {
+		if agentId = strings.TrimSpace(agentId); agentId != "" {
+			agents = append(agents, agentId)
+		}
+	}
+	balance := c.DefaultQuery("balance", BalanceRoundRobin)
+	if err := checkBalance(balance); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	bind := c.Query("bind")
+	if _, err := listenHost(bind); err != nil {
+		c.String(http.StatusBadRequest, "invalid bind, %v", err)
+		return
+	}
+	// TLS of users is terminated with the certificate of the service
+	terminate, err := strconv.ParseBool(c.DefaultQuery("tls", "false"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid tls, %v", err)
+		return
+	}
+	if terminate && network == proto.NetworkUDP {
+		c.String(http.StatusBadRequest, "tls is not terminated for udp")
+		return
+	}
+	var idleTimeout time.Duration
+	if network == proto.NetworkUDP {
+		idleTimeout = DefaultUDPIdleTimeout
+		if v := c.Query("idle-timeout"); v != "" {
+			if idleTimeout, err = time.ParseDuration(v); err != nil || idleTimeout <= 0 {
+				c.String(http.StatusBadRequest, "invalid idle-timeout %s, expected a positive duration like 30s", v)
+				return
+			}
+		}
+	}
+	if terminate {
+		if _, err := serviceCertificate(id); err != nil {
+			c.String(http.StatusBadRequest, "tls requires a certificate, %v", err)
+			return
+		}
+	}
+	meta := ExposureMeta{
+		ServiceId: id,
+		Agents:    agents,
+		Balance:   balance,
+		Bind:      bind,
+		Port:      port,
+		TLS:       terminate,
+		Network:   network,
+
+		IdleTimeout: idleTimeout,
+	}
+	if port == "" && !byHostname {
+		port, err = s.ports.expose(meta)
+	} else {
+		err = NewExposure(meta)
+	}
 	if err != nil {
 		log.Error("failed to create new exposure, %v", err)
+		if err == ErrPortInUse {
+			c.String(http.StatusConflict, "port %s is in use", port)
+			return
+		}
 		c.String(http.StatusInternalServerError, err.Error())
 		return
 	}
-	c.Status(http.StatusOK)
+	svc, err = getService(c, id)
+	if err != nil {
+		log.Error("failed to get service %s, %v", id, err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, svc)
 }
 
 func (s *Server) StopExposingService(c *gin.Context) {
@@ -157,7 +370,57 @@ func (s *Server) StopExposingService(c *gin.Context) {
 		c.Status(http.StatusBadRequest)
 		return
 	}
-	DeleteExposure(id)
+	if err := DeleteExposure(id); err != nil {
+		log.Error("failed to delete exposure of service %s, %v", id, err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func (s *Server) ListAPIKeys(c *gin.Context) {
+	keys, err := listAPIKeys()
+	if err != nil {
+		log.Error("failed to list api keys, %v", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+func (s *Server) CreateAPIKey(c *gin.Context) {
+	var req types.APIKey
+	if err := c.BindJSON(&req); err != nil {
+		log.Error("failed to bind http body as an instance of APIKey, %v", err)
+		c.JSON(http.StatusBadRequest, "body should be an api key")
+		return
+	}
+	key, err := createAPIKey(req.Name, req.Role)
+	if err != nil {
+		log.Error("failed to create api key %s, %v", req.Name, err)
+		if err == ErrAlreadyExist {
+			c.String(http.StatusBadRequest, "already existed")
+			return
+		}
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Info("created api key %s with role %s", key.Name, key.Role)
+	c.JSON(http.StatusOK, key)
+}
+
+func (s *Server) DeleteAPIKey(c *gin.Context) {
+	name := c.Param("name")
+	err := deleteAPIKey(name)
+	if err != nil {
+		log.Error("failed to delete api key %s, %v", name, err)
+		if err == ErrNotFound {
+			c.String(http.StatusNotFound, "not found")
+			return
+		}
+		c.Status(http.StatusInternalServerError)
+		return
+	}
 	c.Status(http.StatusOK)
 }
 
@@ -167,7 +430,18 @@ func (s *Server) httpHandler() http.Handler {
 
 	// log every request and response
 	g.Use(func(c *gin.Context) {
-		dump, _ := httputil.DumpRequest(c.Request, true)
+		// keep api keys out of the log
+		header := c.Request.Header
+		c.Request.Header = header.Clone()
+		for _, h := range []string{"Authorization", "X-Api-Key"} {
+			if c.Request.Header.Get(h) != "" {
+				c.Request.Header.Set(h, "<redacted>")
+			}
+		}
+		// uploaded certificates come with their private keys
+		body := !strings.HasSuffix(c.FullPath(), "/certificate")
+		dump, _ := httputil.DumpRequest(c.Request, body)
+		c.Request.Header = header
 		log.Info("%s", string(dump))
 		c.Next()
 		log.Info("response: %d", c.Writer.Status())
@@ -175,16 +449,25 @@ func (s *Server) httpHandler() http.Handler {
 
 	gin.Logger()
 
+	// agents ask for it before they are able to authenticate
 	g.GET("dataport", s.GetDataPort)
 
-	g.GET("services", s.ListServices)
-	g.POST("services", s.CreateService)
-	g.GET("services/:id", s.GetService)
-	g.PUT("services/:id", s.UpdateService)
-	g.DELETE("services/:id", s.DeleteService)
-	g.GET("agents", s.ListAgents)
-	g.PUT("services/:id/exposure", s.ExposeService)
-	g.DELETE("services/:id/exposure", s.StopExposingService)
+	api := g.Group("", s.authenticate)
+	api.GET("services", s.ListServices)
+	api.POST("services", s.CreateService)
+	api.GET("services/:id", s.GetService)
+	api.PUT("services/:id", s.UpdateService)
+	api.DELETE("services/:id", s.DeleteService)
+	api.GET("agents", s.ListAgents)
+	api.POST("agents/:id/token", s.IssueAgentToken)
+	api.DELETE("agents/:id/token", s.RevokeAgentToken)
+	api.PUT("services/:id/exposure", s.ExposeService)
+	api.DELETE("services/:id/exposure", s.StopExposingService)
+	api.PUT("services/:id/certificate", s.PutCertificate)
+	api.DELETE("services/:id/certificate", s.DeleteCertificate)
+	api.GET("apikeys", s.ListAPIKeys)
+	api.POST("apikeys", s.CreateAPIKey)
+	api.DELETE("apikeys/:name", s.DeleteAPIKey)
 
 	return router
 }
@@ -0,0 +1,24 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExposeUnknownService(t *testing.T) {
+	require := require.New(t)
+	useTestDB(t)
+	gin.SetMode(gin.ReleaseMode)
+	s := &Server{}
+	router := gin.New()
+	router.PUT("/api/v1/services/:id/exposure", s.ExposeService)
+
+	req := httptest.NewRequest(http.MethodPut, "/api/v1/services/unknown/exposure?agent=a1&port=0", nil)
+	rsp := httptest.NewRecorder()
+	router.ServeHTTP(rsp, req)
+	require.Equal(http.StatusNotFound, rsp.Code)
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/vicxqh/srp/log"
+)
+
+// portRange is the range of ports that exposures given no port are allocated from, the zero value
+// allocates nothing.
+type portRange struct {
+	min, max int
+}
+
+// parsePortRange parses a range like 20000-20999, an empty one allocates nothing.
+func parsePortRange(s string) (portRange, error) {
+	if s == "" {
+		return portRange{}, nil
+	}
+	var r portRange
+	bounds := strings.SplitN(s, "-", 2)
+	var err error
+	if r.min, err = strconv.Atoi(bounds[0]); err == nil && len(bounds) == 2 {
+		r.max, err = strconv.Atoi(bounds[1])
+	}
+	if err != nil || len(bounds) != 2 || r.min < 1 || r.max > 65535 || r.min > r.max {
+		return portRange{}, fmt.Errorf("invalid port range %s, expected like 20000-20999", s)
+	}
+	return r, nil
+}
+
+func (r portRange) empty() bool {
+	return r.max == 0
+}
+
+// expose exposes a service on a port of the range, and returns the port. A service that is exposed
+// already keeps its port, other services get the first port that is neither reserved nor in use.
+func (r portRange) expose(meta ExposureMeta) (string, error) {
+	exposeMu.Lock()
+	defer exposeMu.Unlock()
+	if exp := GetExposure(meta.ServiceId); exp != nil && exp.Port != "" {
+		meta.Port = exp.Port
+		return meta.Port, newExposure(meta)
+	}
+	reserved, err := reservedPorts()
+	if err != nil {
+		return "", err
+	}
+	for p := r.min; p <= r.max; p++ {
+		meta.Port = strconv.Itoa(p)
+		if _, ok := reserved[portKey(meta.Network, meta.Port)]; ok {
+			continue
+		}
+		err := newExposure(meta)
+		if err == ErrPortInUse {
+			continue
+		}
+		if err == nil {
+			log.Info("allocated port %s to service %s", meta.Port, meta.ServiceId)
+		}
+		return meta.Port, err
+	}
+	return "", fmt.Errorf("no free port in %d-%d", r.min, r.max)
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vicxqh/srp/types"
+)
+
+func TestParsePortRange(t *testing.T) {
+	require := require.New(t)
+
+	r, err := parsePortRange("20000-20999")
+	require.NoError(err)
+	require.Equal(portRange{20000, 20999}, r)
+	r, err = parsePortRange("")
+	require.NoError(err)
+	require.True(r.empty())
+	for _, invalid := range []string{"20000", "20000-", "2-1", "0-10", "1-65536", "a-b"} {
+		_, err = parsePortRange(invalid)
+		require.Error(err, invalid)
+	}
+}
+
+func TestAllocatePort(t *testing.T) {
+	require := require.New(t)
+	useTestDB(t)
+	ctx := context.Background()
+	for _, id := range []string{"s1", "s2"} {
+		require.NoError(createService(ctx, types.Service{ID: id, Addr: "127.0.0.1:80"}))
+		defer DeleteExposure(id)
+	}
+
+	// the first port of the range is in use
+	lis, err := net.Listen("tcp", ":0")
+	require.NoError(err)
+	defer lis.Close()
+	first := lis.Addr().(*net.TCPAddr).Port
+	r := portRange{first, first + 100}
+
+	p1, err := r.expose(ExposureMeta{ServiceId: "s1", Agents: []string{"a1"}, Balance: BalanceRoundRobin})
+	require.NoError(err)
+	require.NotEqual(strconv.Itoa(first), p1)
+	p2, err := r.expose(ExposureMeta{ServiceId: "s2", Agents: []string{"a1"}, Balance: BalanceRoundRobin})
+	require.NoError(err)
+	require.NotEqual(p1, p2)
+
+	// an exposed service keeps its port
+	again, err := r.expose(ExposureMeta{ServiceId: "s1", Agents: []string{"a2"}, Balance: BalanceRoundRobin})
+	require.NoError(err)
+	require.Equal(p1, again)
+
+	// a reserved port is not taken by another service, even if nothing listens on it
+	GetExposure("s1").Stop()
+	err = NewExposure(ExposureMeta{ServiceId: "s2", Agents: []string{"a1"}, Balance: BalanceRoundRobin, Port: p1})
+	require.Equal(ErrPortInUse, err)
+}
@@ -1,42 +1,196 @@
 package internal
 
 import (
+	gotls "crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/vicxqh/srp/log"
+	"github.com/vicxqh/srp/transport"
+	"github.com/vicxqh/srp/transport/plain"
+	"github.com/vicxqh/srp/transport/tls"
 )
 
+type Config struct {
+	HttpPort int
+	DataPort int
+
+	// Transport is how data connections of agents are carried, transport.Plain or transport.TLS
+	Transport string
+	TLSCert   string
+	TLSKey    string
+	// TLSClientCA enables mutual TLS, agents must present a certificate signed by one of these CAs and
+	// issued to their ID
+	TLSClientCA string
+	// TLSCRL is the revocation list checked against agent certificates
+	TLSCRL string
+
+	// RequireAgentToken rejects agents that have no token issued. Agents that have one must present it
+	// anyway.
+	RequireAgentToken bool
+
+	// AdminKey is an api key with admin role that is not stored in the db, for creating the first keys.
+	// The management api requires a key once AdminKey is set or any key is created.
+	AdminKey string
+
+	// HeartbeatInterval is how often agents are pinged, 0 disables heartbeats. Agents that stay silent for
+	// longer than HeartbeatTimeout are dropped.
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+
+	// ResumeGrace is how long the session of an agent waits to be resumed after its link dropped, streams
+	// of the agent are kept alive meanwhile. 0 disables resumption.
+	ResumeGrace time.Duration
+
+	// DuplicateAgent is the policy for an agent that registers while another one of the same ID is
+	// connected, DuplicateReject, DuplicateTakeover or DuplicateSuffix.
+	DuplicateAgent string
+
+	// MaxAgentConnections is how many data connections an agent may pool, 1 disables pooling.
+	MaxAgentConnections int
+
+	// PortRange is the range of ports that exposures given no port are allocated from, like 20000-20999.
+	// Exposures must be given a port if it is empty.
+	PortRange string
+
+	// VhostHTTPPort is the port of the http front end, which routes requests to services by their Host
+	// header. 0 disables it.
+	VhostHTTPPort int
+	// VhostHTTPSPort is the port of the https front end, which routes TLS connections to services by the
+	// server name of the ClientHello, without decrypting them. 0 disables it.
+	VhostHTTPSPort int
+
+	// CertDir is a directory of certificates that TLS of users is terminated with, named <service id>.crt
+	// and <service id>.key. They are reloaded when changed.
+	CertDir string
+}
+
 type Server struct {
-	httpPort int
-	dataPort int
+	config    Config
+	tlsConfig *gotls.Config
+	ports     portRange
 }
 
-func NewServer(http, data int) *Server {
+func NewServer(config Config) (*Server, error) {
 	gin.SetMode(gin.ReleaseMode)
-	return &Server{
-		httpPort: http,
-		dataPort: data,
+	s := &Server{
+		config: config,
+	}
+	switch config.Transport {
+	case transport.Plain:
+	case transport.TLS:
+		var err error
+		if s.tlsConfig, err = tls.ServerConfig(config.TLSCert, config.TLSKey); err != nil {
+			return nil, err
+		}
+		if config.TLSClientCA != "" {
+			if err = tls.RequireClientCert(s.tlsConfig, config.TLSClientCA, config.TLSCRL); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown transport %s", config.Transport)
+	}
+	switch config.DuplicateAgent {
+	case DuplicateReject, DuplicateTakeover, DuplicateSuffix:
+	default:
+		return nil, fmt.Errorf("unknown duplicate agent policy %s", config.DuplicateAgent)
+	}
+	if config.HeartbeatInterval > 0 && config.HeartbeatTimeout <= config.HeartbeatInterval {
+		return nil, fmt.Errorf("heartbeat timeout %v must be longer than the interval %v", config.HeartbeatTimeout,
+			config.HeartbeatInterval)
+	}
+	var err error
+	if s.ports, err = parsePortRange(config.PortRange); err != nil {
+		return nil, err
+	}
+	if config.MaxAgentConnections < 1 {
+		return nil, fmt.Errorf("an agent needs at least 1 connection, got %d", config.MaxAgentConnections)
 	}
+	if config.CertDir != "" {
+		if err := checkCertDir(config.CertDir); err != nil {
+			return nil, err
+		}
+	}
+	if config.VhostHTTPPort != 0 && config.VhostHTTPPort == config.VhostHTTPSPort {
+		return nil, fmt.Errorf("http and https front ends can not share port %d", config.VhostHTTPPort)
+	}
+	if s.tlsConfig == nil && (config.TLSClientCA != "" || config.TLSCRL != "") {
+		return nil, fmt.Errorf("client certificates require %s transport", transport.TLS)
+	}
+	return s, nil
 }
 
 func (s *Server) DataPort() int {
-	return s.dataPort
+	return s.config.DataPort
+}
+
+// handshakeTimeout limits how long a new agent connection may take to set up
+const handshakeTimeout = 10 * time.Second
+
+// newTransport wraps a new agent connection in the configured transport.
+func (s *Server) newTransport(conn net.Conn) (transport.Transport, error) {
+	if s.tlsConfig == nil {
+		return plain.NewConnection(conn), nil
+	}
+	tc := tls.Server(conn, s.tlsConfig)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := tc.Handshake(); err != nil {
+		return nil, fmt.Errorf("tls handshake failed, %v", err)
+	}
+	return tc, nil
 }
 
 func (s *Server) Run() error {
 	InitDB()
 	defer CloseDB()
 
+	if s.config.CertDir != "" {
+		// exposures terminating TLS need their certificates
+		syncCertDir(s.config.CertDir)
+		go watchCertDir(s.config.CertDir)
+	}
+	RestoreExposures()
+
+	if s.config.AdminKey == "" && !hasAPIKeys() {
+		log.Warn("no api key is configured, the management api is open to everyone. " +
+			"The first key is created with --admin-key, or from the host of the server")
+	}
+
 	go s.AcceptAgents()
 
+	frontEnds := map[int]frontEnd{
+		s.config.VhostHTTPPort:  httpFrontEnd,
+		s.config.VhostHTTPSPort: httpsFrontEnd,
+	}
+	for port, fe := range frontEnds {
+		if port == 0 {
+			continue
+		}
+		addr := fmt.Sprintf(":%d", port)
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s for the %s front end, %v", addr, fe.name, err)
+		}
+		log.Info("routing %s connections on %s by hostname", fe.name, addr)
+		go fe.ServeVhosts(lis)
+	}
+
 	return s.serveHttp()
 }
 
+// vhosts reports whether a front end routes connections to services by hostname.
+func (s *Server) vhosts() bool {
+	return s.config.VhostHTTPPort != 0 || s.config.VhostHTTPSPort != 0
+}
+
 func (s *Server) serveHttp() error {
 	router := s.httpHandler()
-	httpAddr := fmt.Sprintf(":%d", s.httpPort)
+	httpAddr := fmt.Sprintf(":%d", s.config.HttpPort)
 	log.Info("starting http service on %s", httpAddr)
 	return http.ListenAndServe(httpAddr, router)
 }
@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vicxqh/srp/log"
+	"github.com/vicxqh/srp/proto"
+	"github.com/vicxqh/srp/transport"
+)
+
+// DefaultUDPIdleTimeout is how long a user of a udp exposure may stay silent, unless told otherwise.
+const DefaultUDPIdleTimeout = 60 * time.Second
+
+// datagramQueueSize is how many datagrams of a user may wait to be sent to the agent, more are dropped
+const datagramQueueSize = 64
+
+// maxDatagramSize is the size of the largest udp payload
+const maxDatagramSize = 65535
+
+// ServeDatagrams reads datagrams on the port of a udp exposure. Each user address gets a stream of its
+// own, which ends once the user and the service stay silent for the idle timeout of the exposure.
+func (exp *Exposure) ServeDatagrams() {
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := exp.pc.ReadFrom(buffer)
+		if err != nil {
+			if exp.ctx.Err() != nil {
+				// stopped
+				return
+			}
+			log.Error("exposure %s failed to read, %v", exp.ServiceId, err)
+			continue
+		}
+		du := exp.datagramUser(addr)
+		if du == nil {
+			continue
+		}
+		du.push(append([]byte(nil), buffer[:n]...))
+	}
+}
+
+// datagramUser returns the user of addr, a new one is created for an address that is not known yet. It
+// returns nil if no agent is able to take a new user.
+func (exp *Exposure) datagramUser(addr net.Addr) *datagramUser {
+	if v, ok := exp.users.Load(addr.String()); ok {
+		return v.(*datagramUser)
+	}
+	svc, err := getService(exp.ctx, exp.ServiceId)
+	if err != nil {
+		log.Error("failed to get service, %v. service might get updated", err)
+		return nil
+	}
+	log.Info("new udp user %s", addr)
+	ctx, cancel := context.WithCancel(exp.ctx)
+	du := &datagramUser{
+		ctx:      ctx,
+		cancel:   cancel,
+		exposure: exp,
+		user:     addr.String(),
+		addr:     addr,
+		queue:    make(chan []byte, datagramQueueSize),
+	}
+	// the agent may answer as soon as the stream is opened
+	du.timer = time.AfterFunc(exp.IdleTimeout, func() {
+		log.Info("udp user %s of service %s is idle, closing its stream", du.user, exp.ServiceId)
+		du.cancel()
+	})
+	du.stream = addStream(du)
+	header, err := proto.NewOpenHeader(du.stream, du.user, svc.Addr)
+	if err == nil {
+		header.SetNetwork(proto.NetworkUDP)
+		err = exp.openStream(header, du.user, du.setSession)
+	}
+	if err != nil {
+		log.Error("failed to open stream %d for udp user %s, %v", du.stream, du.user, err)
+		du.timer.Stop()
+		streams.Delete(du.stream)
+		cancel()
+		return nil
+	}
+	exp.users.Store(du.user, du)
+	go du.serve()
+	return du
+}
+
+// datagramUser is the stream of a user address of a udp exposure.
+type datagramUser struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	exposure  *Exposure
+	sessionMu sync.Mutex
+	session   *session // the session of an agent that the stream is opened on
+	stream    uint32
+	user      string
+	addr      net.Addr
+	queue     chan []byte // datagrams from the user, waiting to be sent to the agent
+	timer     *time.Timer // ends the stream once it is idle
+	closeOnce sync.Once   // makes sure the agent is told about the end of the stream only once
+}
+
+func (du *datagramUser) setSession(s *session) {
+	du.sessionMu.Lock()
+	du.session = s
+	du.sessionMu.Unlock()
+}
+
+func (du *datagramUser) getSession() *session {
+	du.sessionMu.Lock()
+	defer du.sessionMu.Unlock()
+	return du.session
+}
+
+// push queues a datagram from the user, it is dropped if the agent falls behind.
+func (du *datagramUser) push(datagram []byte) {
+	select {
+	case du.queue <- datagram:
+	default:
+		log.Debug("dropped a datagram of udp user %s, the agent falls behind", du.user)
+	}
+}
+
+// touch postpones the end of an idle stream.
+func (du *datagramUser) touch() {
+	du.timer.Reset(du.exposure.IdleTimeout)
+}
+
+// serve sends the datagrams of the user to the agent, until the stream ends.
+func (du *datagramUser) serve() {
+	s := du.getSession()
+	defer func() {
+		du.timer.Stop()
+		du.closeOnce.Do(func() {
+			if err := s.Send(transport.Segment{Header: proto.NewHeader(proto.TypeClose, du.stream)}); err != nil {
+				log.Error("failed to close stream %d on agent %s, %v", du.stream, s.agent.ID, err)
+			}
+		})
+		s.countStream(-1)
+		streams.Delete(du.stream)
+		du.exposure.users.Delete(du.user)
+		log.Info("removed udp user %s, stream %d", du.user, du.stream)
+	}()
+	for {
+		select {
+		case <-du.ctx.Done():
+			return
+		case datagram := <-du.queue:
+			du.touch()
+			header := proto.NewHeader(proto.TypeDatagram, du.stream)
+			header.SetPayloadLength(uint32(len(datagram)))
+			if err := s.Send(transport.Segment{Header: header, Payload: datagram}); err != nil {
+				log.Error("failed to send to agent %s, %v", s.agent.ID, err)
+				return
+			}
+		}
+	}
+}
+
+// forward handles a segment of the stream received on session s.
+func (du *datagramUser) forward(s *session, segment transport.Segment) error {
+	header := segment.Header
+	if du.getSession() != s {
+		return fmt.Errorf("agent %s sent %s segment of stream %d which does not belong to the session",
+			s.agent.ID, header.Type(), header.Stream())
+	}
+	switch header.Type() {
+	case proto.TypeDatagram:
+		du.touch()
+		if _, err := du.exposure.pc.WriteTo(segment.Payload, du.addr); err != nil {
+			log.Warn("failed to write to udp user %s, %v", du.user, err)
+		}
+		return nil
+	case proto.TypeClose, proto.TypeReset:
+		if len(segment.Payload) > 0 {
+			log.Warn("agent %s reset stream %d of udp user %s, %s", s.agent.ID, du.stream, du.user, segment.Payload)
+		}
+		du.closeOnce.Do(func() {})
+		du.cancel()
+		return nil
+	case proto.TypeWindowUpdate:
+		// datagrams are not flow controlled
+		return nil
+	}
+	return fmt.Errorf("unexpected %s segment of udp stream %d", header.Type(), header.Stream())
+}
@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vicxqh/srp/proto"
+	"github.com/vicxqh/srp/transport"
+	"github.com/vicxqh/srp/types"
+)
+
+func TestDatagramUser(t *testing.T) {
+	require := require.New(t)
+	useTestDB(t)
+	require.NoError(createService(context.Background(), types.Service{ID: "dns", Addr: "10.0.0.53:53"}))
+	a, ss := newTestAgent(t, "udp", 1)
+	defer a.end()
+	a.datagrams = true
+
+	require.NoError(NewExposure(ExposureMeta{ServiceId: "dns", Agents: []string{"udp"}, Balance: BalanceRoundRobin,
+		Bind: "127.0.0.1", Port: "0", Network: proto.NetworkUDP, IdleTimeout: 200 * time.Millisecond}))
+	defer DeleteExposure("dns")
+	exp := GetExposure("dns")
+	user, err := net.Dial("udp", exp.pc.LocalAddr().String())
+	require.NoError(err)
+	defer user.Close()
+
+	// the first datagram of a user opens a udp stream
+	_, err = user.Write([]byte("query"))
+	require.NoError(err)
+	open := <-ss[0].sendChan
+	require.Equal(proto.TypeOpen, open.Header.Type())
+	require.Equal(proto.NetworkUDP, open.Header.Network())
+	require.Equal("10.0.0.53:53", open.Header.Service())
+	datagram := <-ss[0].sendChan
+	require.Equal(proto.TypeDatagram, datagram.Header.Type())
+	require.Equal(open.Header.Stream(), datagram.Header.Stream())
+	require.Equal("query", string(datagram.Payload))
+
+	header := proto.NewHeader(proto.TypeDatagram, open.Header.Stream())
+	header.SetPayloadLength(6)
+	require.NoError(ForwardToUser(ss[0], transport.Segment{Header: header, Payload: []byte("answer")}))
+	buffer := make([]byte, maxDatagramSize)
+	user.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := user.Read(buffer)
+	require.NoError(err)
+	require.Equal("answer", string(buffer[:n]))
+
+	// the stream ends once it is idle
+	select {
+	case closed := <-ss[0].sendChan:
+		require.Equal(proto.TypeClose, closed.Header.Type())
+		require.Equal(open.Header.Stream(), closed.Header.Stream())
+	case <-time.After(time.Second):
+		require.Fail("idle stream is not closed")
+	}
+	require.Eventually(func() bool {
+		_, ok := exp.users.Load(user.LocalAddr().String())
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
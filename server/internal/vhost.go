@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	gotls "crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vicxqh/srp/log"
+)
+
+// maxRequestHead limits how much of a connection a front end reads to find the hostname
+const maxRequestHead = 64 << 10
+
+// frontEnd is a listener shared by services, which routes each connection to the service whose hostname
+// is found in the first bytes of the connection.
+type frontEnd struct {
+	name string
+	// peek reads the hostname from conn, and returns it along with the bytes read
+	peek func(conn net.Conn) (string, []byte, error)
+	// reject tells the user why the connection is not routed, and closes it
+	reject func(conn net.Conn, code int, msg string)
+	// terminate is set if TLS is terminated for exposures that ask for it
+	terminate bool
+}
+
+// httpFrontEnd routes by the Host header of the first request, every later request on the connection
+// goes to the same service.
+var httpFrontEnd = frontEnd{name: "http", peek: readHost, reject: replyHTTPError}
+
+// httpsFrontEnd routes by the server name of the TLS ClientHello. The encrypted stream is passed through
+// to the service, unless the exposure of the service terminates TLS.
+var httpsFrontEnd = frontEnd{name: "https", peek: readServerName, reject: closeConn, terminate: true}
+
+// ServeVhosts accepts connections on the listener of a front end.
+func (fe frontEnd) ServeVhosts(lis net.Listener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			log.Error("%s front end failed to accept, %v", fe.name, err)
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go fe.route(conn)
+	}
+}
+
+func (fe frontEnd) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	host, head, err := fe.peek(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Warn("bad request from %s on the %s front end, %v", conn.RemoteAddr(), fe.name, err)
+		fe.reject(conn, http.StatusBadRequest, "bad request")
+		return
+	}
+	id, err := findServiceByHostname(host)
+	if err != nil {
+		log.Warn("no service for host %s requested by %s, %v", host, conn.RemoteAddr(), err)
+		fe.reject(conn, http.StatusNotFound, fmt.Sprintf("no service for host %s", host))
+		return
+	}
+	exp := GetExposure(id)
+	if exp == nil {
+		log.Warn("service %s of host %s is not exposed", id, host)
+		fe.reject(conn, http.StatusServiceUnavailable, fmt.Sprintf("service %s is not exposed", id))
+		return
+	}
+	conn = &prefixConn{Conn: conn, prefix: head}
+	if fe.terminate {
+		exp.acceptUser(conn)
+		return
+	}
+	exp.handleUserConnection(conn)
+}
+
+// readHost reads the head of the first request on conn, and returns the host it is for along with the
+// bytes read, which are still to be forwarded.
+func readHost(conn net.Conn) (string, []byte, error) {
+	var head bytes.Buffer
+	req, err := http.ReadRequest(bufio.NewReader(io.TeeReader(io.LimitReader(conn, maxRequestHead), &head)))
+	if err != nil {
+		return "", nil, err
+	}
+	host := normalizeHost(req.Host)
+	if host == "" {
+		return "", nil, fmt.Errorf("no host in request for %s", req.URL)
+	}
+	return host, head.Bytes(), nil
+}
+
+// errPeeked stops the handshake that readServerName runs, once the ClientHello is read
+var errPeeked = errors.New("client hello is read")
+
+// readServerName reads the TLS ClientHello on conn, and returns the server name in it along with the bytes
+// read, which are still to be forwarded. Nothing is written to conn.
+func readServerName(conn net.Conn) (string, []byte, error) {
+	var head bytes.Buffer
+	var host string
+	err := gotls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(io.LimitReader(conn, maxRequestHead), &head)},
+		&gotls.Config{
+			GetConfigForClient: func(hello *gotls.ClientHelloInfo) (*gotls.Config, error) {
+				host = normalizeHost(hello.ServerName)
+				return nil, errPeeked
+			},
+		}).Handshake()
+	if !errors.Is(err, errPeeked) {
+		return "", nil, err
+	}
+	if host == "" {
+		return "", nil, errors.New("no server name in client hello")
+	}
+	return host, head.Bytes(), nil
+}
+
+// readOnlyConn reads from r, and refuses to write, so that a TLS handshake run on it can not answer the
+// user.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c readOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// normalizeHost strips the port and the trailing dot of the Host header of a request, so that it
+// compares equal to hostnames of services.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// checkHostname validates the hostname of a service and returns it in the form that requests are matched
+// against.
+func checkHostname(hostname string) (string, error) {
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	if len(hostname) > 253 {
+		return "", fmt.Errorf("hostname %s is too long", hostname)
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return "", fmt.Errorf("invalid hostname %s", hostname)
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return "", fmt.Errorf("invalid hostname %s", hostname)
+			}
+		}
+	}
+	return hostname, nil
+}
+
+// replyHTTPError answers a request that can not be routed, and closes conn.
+func replyHTTPError(conn net.Conn, code int, msg string) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\n"+
+		"Connection: close\r\n\r\n%s\n", code, http.StatusText(code), len(msg)+1, msg)
+}
+
+// closeConn rejects a connection that can not be answered in its protocol.
+func closeConn(conn net.Conn, code int, msg string) {
+	conn.Close()
+}
+
+// prefixConn is a connection that data has been read from already, the data is read again first.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// CloseWrite closes the sending side of the connection, if the connection is able to.
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return fmt.Errorf("%T is not able to close its sending side", c.Conn)
+}
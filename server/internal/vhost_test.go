@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"context"
+	gotls "crypto/tls"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vicxqh/srp/types"
+)
+
+func TestReadHost(t *testing.T) {
+	require := require.New(t)
+
+	request := "POST /edit HTTP/1.1\r\nHost: Wiki.Example.com:8080\r\nContent-Length: 5\r\n\r\nhello"
+	user, conn := net.Pipe()
+	go func() {
+		user.Write([]byte(request))
+		user.Close()
+	}()
+	host, head, err := readHost(conn)
+	require.NoError(err)
+	require.Equal("wiki.example.com", host)
+
+	// the request is forwarded as it was sent
+	data, err := ioutil.ReadAll(&prefixConn{Conn: conn, prefix: head})
+	require.NoError(err)
+	require.Equal(request, string(data))
+
+	user, conn = net.Pipe()
+	go func() {
+		user.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		user.Close()
+	}()
+	_, _, err = readHost(conn)
+	require.Error(err)
+}
+
+func TestReadServerName(t *testing.T) {
+	require := require.New(t)
+
+	user, conn := net.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- gotls.Client(user, &gotls.Config{ServerName: "Secure.Example.com"}).Handshake()
+	}()
+	host, head, err := readServerName(conn)
+	require.NoError(err)
+	require.Equal("secure.example.com", host)
+	// a handshake record, passed through untouched
+	require.Equal(byte(0x16), head[0])
+	conn.Close()
+	require.Error(<-done)
+
+	user, conn = net.Pipe()
+	go func() {
+		done <- gotls.Client(user, &gotls.Config{InsecureSkipVerify: true}).Handshake()
+	}()
+	_, _, err = readServerName(conn)
+	require.Error(err)
+	conn.Close()
+	<-done
+}
+
+func TestCheckHostname(t *testing.T) {
+	require := require.New(t)
+
+	hostname, err := checkHostname("Wiki.Tunnel.example.com.")
+	require.NoError(err)
+	require.Equal("wiki.tunnel.example.com", hostname)
+	for _, invalid := range []string{"", "wiki..example.com", "wiki.example.com:80", "-wiki.example.com", "wiki_1"} {
+		_, err = checkHostname(invalid)
+		require.Error(err, invalid)
+	}
+}
+
+func TestFindServiceByHostname(t *testing.T) {
+	require := require.New(t)
+	useTestDB(t)
+	ctx := context.Background()
+
+	require.NoError(createService(ctx, types.Service{ID: "wiki", Addr: "10.0.0.1:80", Hostname: "wiki.example.com"}))
+	require.Equal(ErrHostnameTaken,
+		createService(ctx, types.Service{ID: "blog", Addr: "10.0.0.2:80", Hostname: "wiki.example.com"}))
+	require.NoError(createService(ctx, types.Service{ID: "blog", Addr: "10.0.0.2:80"}))
+	require.Equal(ErrHostnameTaken,
+		updateService(ctx, "blog", types.Service{ID: "blog", Addr: "10.0.0.2:80", Hostname: "wiki.example.com"}))
+
+	id, err := findServiceByHostname("wiki.example.com")
+	require.NoError(err)
+	require.Equal("wiki", id)
+
+	// the hostname moves to another service once it is given up
+	require.NoError(updateService(ctx, "wiki", types.Service{ID: "wiki", Addr: "10.0.0.1:80"}))
+	require.NoError(updateService(ctx, "blog",
+		types.Service{ID: "blog", Addr: "10.0.0.2:80", Hostname: "wiki.example.com"}))
+	id, err = findServiceByHostname("wiki.example.com")
+	require.NoError(err)
+	require.Equal("blog", id)
+	_, err = findServiceByHostname("www.example.com")
+	require.Equal(ErrNotFound, err)
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/vicxqh/srp/server/internal"
+	"github.com/vicxqh/srp/transport"
 
 	flag "github.com/spf13/pflag"
 	"github.com/vicxqh/srp/log"
@@ -15,6 +17,27 @@ var (
 	logLevel string
 	httpPort int
 	dataPort int
+
+	transportName string
+	tlsCert       string
+	tlsKey        string
+	tlsClientCA   string
+	tlsCRL        string
+
+	requireAgentToken bool
+	adminKey          string
+
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	resumeGrace       time.Duration
+	duplicateAgent    string
+
+	maxAgentConnections int
+	portRange           string
+
+	vhostHTTPPort  int
+	vhostHTTPSPort int
+	certDir        string
 )
 
 func init() {
@@ -22,6 +45,35 @@ func init() {
 	flag.StringVar(&logLevel, "log-level", "info", "log level.[info|debug|warning|error]")
 	flag.IntVar(&httpPort, "http", 8010, "http service port")
 	flag.IntVar(&dataPort, "data", 8011, "data forwarding port")
+	flag.StringVar(&transportName, "transport", transport.Plain, "transport of data connections.[plain|tls]")
+	flag.StringVar(&tlsCert, "tls-cert", "", "certificate file presented to agents, required by tls transport")
+	flag.StringVar(&tlsKey, "tls-key", "", "private key file of tls-cert")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "",
+		"CA bundle for verifying agent certificates. If set, agents must present a certificate issued to their name")
+	flag.StringVar(&tlsCRL, "tls-crl", "", "certificate revocation list checked against agent certificates")
+	flag.BoolVar(&requireAgentToken, "require-agent-token", false,
+		"reject agents without a token issued by POST /api/v1/agents/:id/token")
+	flag.StringVar(&adminKey, "admin-key", os.Getenv("SRP_ADMIN_KEY"),
+		"api key with admin role, for creating api keys stored in the db. $SRP_ADMIN_KEY by default")
+	flag.DurationVar(&heartbeatInterval, "heartbeat-interval", 15*time.Second, "how often agents are pinged, 0 disables it")
+	flag.DurationVar(&heartbeatTimeout, "heartbeat-timeout", 45*time.Second,
+		"agents that stay silent for longer are dropped")
+	flag.DurationVar(&resumeGrace, "resume-grace", 30*time.Second,
+		"how long streams of an agent whose link dropped are kept for it to reconnect, 0 disables it")
+	flag.StringVar(&duplicateAgent, "duplicate-agent", internal.DuplicateTakeover,
+		"what to do with an agent whose ID is connected already.[reject|takeover|suffix] "+
+			"takeover requires the agent to present a token or a client certificate")
+	flag.IntVar(&maxAgentConnections, "max-agent-connections", 8,
+		"how many data connections an agent may open in parallel, 1 disables it")
+	flag.StringVar(&portRange, "port-range", "",
+		"ports allocated to exposures that are given no port, like 20000-20999. A port must be given if empty")
+	flag.IntVar(&vhostHTTPPort, "vhost-http", 0,
+		"port of the http front end, which routes requests to services by their hostname. 0 disables it")
+	flag.IntVar(&vhostHTTPSPort, "vhost-https", 0,
+		"port of the https front end, which routes TLS connections to services by their hostname "+
+			"without decrypting them. 0 disables it")
+	flag.StringVar(&certDir, "cert-dir", "",
+		"directory of certificates for terminating TLS of users, named <service id>.crt and <service id>.key")
 }
 
 func main() {
@@ -33,6 +85,34 @@ func main() {
 	}
 	log.SetLevelString(logLevel)
 
-	s := internal.NewServer(httpPort, dataPort)
+	s, err := internal.NewServer(internal.Config{
+		HttpPort:  httpPort,
+		DataPort:  dataPort,
+		Transport: transportName,
+		TLSCert:   tlsCert,
+		TLSKey:    tlsKey,
+
+		TLSClientCA: tlsClientCA,
+		TLSCRL:      tlsCRL,
+
+		RequireAgentToken: requireAgentToken,
+		AdminKey:          adminKey,
+
+		HeartbeatInterval: heartbeatInterval,
+		HeartbeatTimeout:  heartbeatTimeout,
+		ResumeGrace:       resumeGrace,
+		DuplicateAgent:    duplicateAgent,
+
+		MaxAgentConnections: maxAgentConnections,
+		PortRange:           portRange,
+
+		VhostHTTPPort:  vhostHTTPPort,
+		VhostHTTPSPort: vhostHTTPSPort,
+		CertDir:        certDir,
+	})
+	if err != nil {
+		fmt.Println("failed to create server,", err)
+		os.Exit(1)
+	}
 	s.Run()
 }
@@ -0,0 +1,153 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/vicxqh/srp/proto"
+)
+
+// NewWindowUpdate creates a WINDOW_UPDATE segment which grants the peer increment more bytes on stream.
+func NewWindowUpdate(stream uint32, increment uint32) Segment {
+	header := proto.NewHeader(proto.TypeWindowUpdate, stream)
+	header.SetPayloadLength(4)
+	return Segment{
+		Header:  header,
+		Payload: []byte{byte(increment >> 24), byte(increment >> 16), byte(increment >> 8), byte(increment)},
+	}
+}
+
+// WindowIncrement returns the increment carried by a WINDOW_UPDATE segment.
+func WindowIncrement(segment Segment) (uint32, error) {
+	if segment.Header.Type() != proto.TypeWindowUpdate || len(segment.Payload) != 4 {
+		return 0, fmt.Errorf("malformed %s segment of stream %d", segment.Header.Type(), segment.Header.Stream())
+	}
+	p := segment.Payload
+	return uint32(p[0])<<24 | uint32(p[1])<<16 | uint32(p[2])<<8 | uint32(p[3]), nil
+}
+
+// Window is the credit a stream has for sending data to the peer. A stream that runs out of credit waits
+// for the peer to grant more, without holding up other streams on the same link.
+type Window struct {
+	mu     sync.Mutex
+	avail  int
+	notify chan struct{}
+}
+
+func NewWindow(size int) *Window {
+	return &Window{
+		avail:  size,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Acquire takes at most n bytes of credit. It blocks until some credit is available or ctx is done.
+func (w *Window) Acquire(ctx context.Context, n int) (int, error) {
+	for {
+		w.mu.Lock()
+		if w.avail > 0 {
+			if n > w.avail {
+				n = w.avail
+			}
+			w.avail -= n
+			w.mu.Unlock()
+			return n, nil
+		}
+		w.mu.Unlock()
+
+		select {
+		case <-w.notify:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// Release gives credit back to the window, either the unused part of an Acquire or an increment granted by
+// the peer.
+func (w *Window) Release(n int) {
+	w.mu.Lock()
+	w.avail += n
+	w.mu.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// ErrWindowExceeded is returned by Queue.Push when the peer sends more than it has been granted.
+var ErrWindowExceeded = errors.New("peer sent more than the window allows")
+
+// Queue buffers the data received on a stream until it is written out, so that a slow consumer never blocks
+// the link the data came from. The peer's Window keeps it from holding more than the receive window.
+type Queue struct {
+	mu       sync.Mutex
+	items    [][]byte
+	limit    int
+	size     int // bytes received and not granted back to the peer yet
+	consumed int // bytes written out and not granted back to the peer yet
+	notify   chan struct{}
+}
+
+func NewQueue(limit int) *Queue {
+	return &Queue{
+		limit:  limit,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Push appends data to the queue without blocking. A nil data is queued as is, to mark the end of the stream.
+func (q *Queue) Push(data []byte) error {
+	q.mu.Lock()
+	if q.size+len(data) > q.limit {
+		q.mu.Unlock()
+		return ErrWindowExceeded
+	}
+	q.size += len(data)
+	q.items = append(q.items, data)
+	q.mu.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pop removes the oldest data from the queue. It blocks until there is one or ctx is done.
+func (q *Queue) Pop(ctx context.Context) ([]byte, error) {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			data := q.items[0]
+			q.items[0] = nil
+			q.items = q.items[1:]
+			q.mu.Unlock()
+			return data, nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Consume records that n popped bytes have been written out, and returns how many bytes should be granted
+// back to the peer right now. Grants are batched, but never held back once the queue is drained, or the
+// peer might wait forever.
+func (q *Queue) Consume(n int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.consumed += n
+	if q.consumed < q.limit/4 && len(q.items) > 0 {
+		return 0
+	}
+	grant := q.consumed
+	q.consumed = 0
+	q.size -= grant
+	return grant
+}
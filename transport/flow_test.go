@@ -0,0 +1,84 @@
+package transport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWindowUpdate(t *testing.T) {
+	require := require.New(t)
+
+	seg := NewWindowUpdate(3, 65536)
+	require.Equal(uint32(3), seg.Header.Stream())
+	inc, err := WindowIncrement(seg)
+	require.Nil(err)
+	require.Equal(uint32(65536), inc)
+
+	seg.Payload = seg.Payload[:3]
+	_, err = WindowIncrement(seg)
+	require.NotNil(err)
+}
+
+func TestWindow(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	w := NewWindow(10)
+	n, err := w.Acquire(ctx, 4)
+	require.Nil(err)
+	require.Equal(4, n)
+	n, err = w.Acquire(ctx, 100)
+	require.Nil(err)
+	require.Equal(6, n)
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = w.Acquire(timeout, 1)
+	require.NotNil(err)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		w.Release(3)
+	}()
+	n, err = w.Acquire(ctx, 100)
+	require.Nil(err)
+	require.Equal(3, n)
+}
+
+func TestQueue(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	q := NewQueue(8)
+	require.Nil(q.Push([]byte("abcd")))
+	require.Nil(q.Push([]byte("ef")))
+	require.Equal(ErrWindowExceeded, q.Push([]byte("ghi")))
+
+	data, err := q.Pop(ctx)
+	require.Nil(err)
+	require.Equal("abcd", string(data))
+	// 4 bytes are over a quarter of the limit, all of them are granted back
+	require.Equal(4, q.Consume(len(data)))
+
+	data, err = q.Pop(ctx)
+	require.Nil(err)
+	require.Equal("ef", string(data))
+	// drained, grant back everything
+	require.Equal(2, q.Consume(len(data)))
+
+	require.Nil(q.Push([]byte("12345678")))
+	require.Nil(q.Push(nil))
+	data, _ = q.Pop(ctx)
+	require.Equal(8, q.Consume(len(data)))
+	data, err = q.Pop(ctx)
+	require.Nil(err)
+	require.Nil(data)
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = q.Pop(timeout)
+	require.NotNil(err)
+}
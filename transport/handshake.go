@@ -0,0 +1,31 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/vicxqh/srp/proto"
+)
+
+// SendHandshake sends v as the json payload of a HANDSHAKE segment.
+func SendHandshake(t Transport, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	header := proto.NewHeader(proto.TypeHandshake, 0)
+	header.SetPayloadLength(uint32(len(data)))
+	return t.Send(Segment{Header: header, Payload: data})
+}
+
+// ReceiveHandshake receives a HANDSHAKE segment and unmarshals its json payload into v.
+func ReceiveHandshake(t Transport, v interface{}) error {
+	segment, err := t.Receive()
+	if err != nil {
+		return err
+	}
+	if segment.Header.Type() != proto.TypeHandshake {
+		return fmt.Errorf("expected %s segment, got %s", proto.TypeHandshake, segment.Header.Type())
+	}
+	return json.Unmarshal(segment.Payload, v)
+}
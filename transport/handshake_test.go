@@ -0,0 +1,38 @@
+package transport_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vicxqh/srp/proto"
+	"github.com/vicxqh/srp/transport"
+	"github.com/vicxqh/srp/transport/plain"
+	"github.com/vicxqh/srp/types"
+)
+
+func TestHandshake(t *testing.T) {
+	require := require.New(t)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	agent, server := plain.NewConnection(c1), plain.NewConnection(c2)
+
+	req := types.AgentRegistrationRequest{
+		Agent:        types.Agent{ID: "a1", Description: string(make([]byte, 4096))},
+		Version:      proto.Version,
+		Capabilities: []string{"x"},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- transport.SendHandshake(agent, req) }()
+	var got types.AgentRegistrationRequest
+	require.Nil(transport.ReceiveHandshake(server, &got))
+	require.Nil(<-errc)
+	require.Equal(req, got)
+
+	// anything else is rejected
+	go func() { errc <- agent.Send(transport.NewWindowUpdate(1, 1)) }()
+	require.NotNil(transport.ReceiveHandshake(server, &got))
+	require.Nil(<-errc)
+}
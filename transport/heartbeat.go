@@ -0,0 +1,55 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/vicxqh/srp/proto"
+)
+
+// NewPing creates a PING segment.
+func NewPing() Segment {
+	return Segment{Header: proto.NewHeader(proto.TypePing, 0)}
+}
+
+// NewPong creates the PONG segment answering a PING.
+func NewPong() Segment {
+	return Segment{Header: proto.NewHeader(proto.TypePong, 0)}
+}
+
+// Heartbeat detects links that died silently, which is otherwise not noticed until a write fails. Every
+// segment received from the peer proves that the link is alive, PINGs make sure there is some.
+type Heartbeat struct {
+	Interval time.Duration // how often to ping the peer
+	Timeout  time.Duration // how long the peer may stay silent
+	lastSeen int64         // unix nano of the last segment received
+}
+
+// Seen records that a segment has just been received from the peer.
+func (hb *Heartbeat) Seen() {
+	atomic.StoreInt64(&hb.lastSeen, time.Now().UnixNano())
+}
+
+// Run pings the peer by calling ping every Interval. It returns an error once the peer has been silent
+// for longer than Timeout, or nil when ctx is done.
+func (hb *Heartbeat) Run(ctx context.Context, ping func() error) error {
+	hb.Seen()
+	ticker := time.NewTicker(hb.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		silent := time.Since(time.Unix(0, atomic.LoadInt64(&hb.lastSeen)))
+		if silent > hb.Timeout {
+			return fmt.Errorf("peer has been silent for %v", silent.Round(time.Millisecond))
+		}
+		if err := ping(); err != nil {
+			return err
+		}
+	}
+}
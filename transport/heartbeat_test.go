@@ -0,0 +1,51 @@
+package transport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeartbeat(t *testing.T) {
+	require := require.New(t)
+
+	hb := &Heartbeat{Interval: 10 * time.Millisecond, Timeout: 50 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	pings := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- hb.Run(ctx, func() error {
+			pings++
+			// the peer answers the first pings only
+			if pings < 5 {
+				hb.Seen()
+			}
+			return nil
+		})
+	}()
+	select {
+	case err := <-done:
+		require.NotNil(err)
+		require.True(pings >= 5)
+	case <-time.After(time.Second):
+		t.Fatal("silent peer is not detected")
+	}
+
+	// a live peer is never timed out
+	hb.Seen()
+	go func() {
+		done <- hb.Run(ctx, func() error {
+			hb.Seen()
+			return nil
+		})
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("live peer is timed out, %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	cancel()
+	require.Nil(<-done)
+}
@@ -1,6 +1,10 @@
 package transport
 
-import "github.com/vicxqh/srp/proto"
+import (
+	"net"
+
+	"github.com/vicxqh/srp/proto"
+)
 
 type Segment struct {
 	Header  proto.Header
@@ -10,4 +14,19 @@ type Segment struct {
 type Transport interface {
 	Receive() (Segment, error)
 	Send(Segment) error
+	// Conn returns the connection that segments are carried on.
+	Conn() net.Conn
+}
+
+// names of transports
+const (
+	Plain = "plain"
+	TLS   = "tls"
+)
+
+// NewReset creates a RESET segment of stream, reason is told to the peer if it is not empty.
+func NewReset(stream uint32, reason string) Segment {
+	header := proto.NewHeader(proto.TypeReset, stream)
+	header.SetPayloadLength(uint32(len(reason)))
+	return Segment{Header: header, Payload: []byte(reason)}
 }
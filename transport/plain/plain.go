@@ -18,16 +18,18 @@ func NewConnection(conn net.Conn) *Connection {
 	return &Connection{conn}
 }
 
+func (c *Connection) Conn() net.Conn {
+	return c.conn
+}
+
 func (c *Connection) Receive() (seg transport.Segment, err error) {
-	seg.Header = make(proto.Header, proto.HeaderSize)
-	n, err := io.ReadFull(c.conn, seg.Header)
-	//n, err := c.conn.Read(seg.Header)
-	if err != nil || n != proto.HeaderSize {
-		log.Error("failed to read header, size %d, error %v", n, err)
+	seg.Header, err = proto.ReadHeader(c.conn)
+	if err != nil {
+		log.Error("failed to read header, %v", err)
 		return
 	}
 	seg.Payload = make([]byte, seg.Header.PayloadLength())
-	n, err = io.ReadFull(c.conn, seg.Payload)
+	n, err := io.ReadFull(c.conn, seg.Payload)
 	//n, err = c.conn.Read(seg.Payload)
 	if err != nil || n != len(seg.Payload) {
 		log.Error("failed to read payload, size %d (expected %d), error %v", n, len(seg.Payload), err)
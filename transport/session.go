@@ -0,0 +1,127 @@
+package transport
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/vicxqh/srp/proto"
+)
+
+// AckEvery is how many segments are received before the peer is told with an ACK.
+const AckEvery = 32
+
+// NewAck creates an ACK segment which tells the peer that received segments of the session have arrived.
+func NewAck(received uint64) Segment {
+	header := proto.NewHeader(proto.TypeAck, 0)
+	header.SetPayloadLength(8)
+	payload := make([]byte, 8)
+	for i := range payload {
+		payload[i] = byte(received >> (56 - 8*uint(i)))
+	}
+	return Segment{Header: header, Payload: payload}
+}
+
+// AckCount returns the count carried by an ACK segment.
+func AckCount(segment Segment) (uint64, error) {
+	if segment.Header.Type() != proto.TypeAck || len(segment.Payload) != 8 {
+		return 0, fmt.Errorf("malformed %s segment", segment.Header.Type())
+	}
+	var n uint64
+	for _, b := range segment.Payload {
+		n = n<<8 | uint64(b)
+	}
+	return n, nil
+}
+
+// Resumable tells whether segment belongs to the session rather than to the link it is sent on.
+// Segments of the session are counted and replayed on a new link, link segments are not.
+func Resumable(segment Segment) bool {
+	switch segment.Header.Type() {
+	case proto.TypeHandshake, proto.TypePing, proto.TypePong, proto.TypeAck:
+		return false
+	}
+	return true
+}
+
+// ControlQueueSize is how many link segments, like PONGs and ACKs, may wait to be sent on a link. They are
+// sent ahead of segments of the session, and are dropped rather than waited for if the link falls behind.
+const ControlQueueSize = 8
+
+// Session keeps what is needed to carry on with the streams of a peer on a new link after the old one
+// dropped: the segments that the peer may have missed, and how many segments have been received from it.
+type Session struct {
+	ID string // empty if the session can not be resumed
+
+	mu       sync.Mutex
+	acked    uint64    // how many sent segments the peer has received
+	unacked  []Segment // segments sent after the acked ones, oldest first
+	received uint64
+}
+
+// NewSession creates a session, it gets a random ID if it is resumable.
+func NewSession(resumable bool) (*Session, error) {
+	s := &Session{}
+	if resumable {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s.ID = hex.EncodeToString(b)
+	}
+	return s, nil
+}
+
+// Sent records a segment that is about to be sent, so that it is replayed if the link drops before the
+// peer acknowledges it. Nothing is kept for a session that can not be resumed, the peer never acknowledges it.
+func (s *Session) Sent(segment Segment) {
+	if s.ID == "" || !Resumable(segment) {
+		return
+	}
+	s.mu.Lock()
+	s.unacked = append(s.unacked, segment)
+	s.mu.Unlock()
+}
+
+// Received counts a segment received from the peer, and returns how many have been received. Segments are
+// not counted for a session that can not be resumed.
+func (s *Session) Received(segment Segment) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ID != "" && Resumable(segment) {
+		s.received++
+	}
+	return s.received
+}
+
+// ReceivedCount returns how many segments have been received from the peer.
+func (s *Session) ReceivedCount() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received
+}
+
+// Ack drops the segments that the peer has received, received is the count told by the peer.
+func (s *Session) Ack(received uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if received < s.acked {
+		// acks may cross a resumption, an older one tells nothing new
+		return nil
+	}
+	n := received - s.acked
+	if n > uint64(len(s.unacked)) {
+		return fmt.Errorf("peer received %d segments, only %d were sent", received, s.acked+uint64(len(s.unacked)))
+	}
+	s.unacked = append([]Segment(nil), s.unacked[n:]...)
+	s.acked = received
+	return nil
+}
+
+// Unacked returns the segments that the peer has not acknowledged, they are replayed on a new link.
+func (s *Session) Unacked() []Segment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Segment(nil), s.unacked...)
+}
@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vicxqh/srp/proto"
+)
+
+func TestAck(t *testing.T) {
+	require := require.New(t)
+
+	seg := NewAck(1<<40 + 5)
+	require.Equal(proto.TypeAck, seg.Header.Type())
+	require.Equal(uint32(8), seg.Header.PayloadLength())
+	n, err := AckCount(seg)
+	require.Nil(err)
+	require.Equal(uint64(1<<40+5), n)
+
+	_, err = AckCount(NewWindowUpdate(1, 1))
+	require.NotNil(err)
+}
+
+func TestSession(t *testing.T) {
+	require := require.New(t)
+
+	s, err := NewSession(true)
+	require.Nil(err)
+	require.Len(s.ID, 32)
+	s2, err := NewSession(true)
+	require.Nil(err)
+	require.NotEqual(s.ID, s2.ID)
+	s2, err = NewSession(false)
+	require.Nil(err)
+	require.Empty(s2.ID)
+
+	data := func(stream uint32) Segment {
+		return Segment{Header: proto.NewHeader(proto.TypeData, stream)}
+	}
+	for i := uint32(1); i <= 5; i++ {
+		s.Sent(data(i))
+	}
+	// link segments are not replayed
+	s.Sent(NewPing())
+	s.Sent(NewAck(1))
+	require.Len(s.Unacked(), 5)
+
+	require.Nil(s.Ack(2))
+	unacked := s.Unacked()
+	require.Len(unacked, 3)
+	require.Equal(uint32(3), unacked[0].Header.Stream())
+
+	// stale ack
+	require.Nil(s.Ack(1))
+	require.Len(s.Unacked(), 3)
+
+	require.NotNil(s.Ack(6))
+	require.Nil(s.Ack(5))
+	require.Empty(s.Unacked())
+
+	require.Equal(uint64(1), s.Received(data(1)))
+	require.Equal(uint64(1), s.Received(NewPong()))
+	require.Equal(uint64(2), s.Received(NewWindowUpdate(1, 1)))
+	require.Equal(uint64(2), s.ReceivedCount())
+
+	// nothing is kept for a session that is not resumable, its peer never acknowledges it
+	for i := uint32(1); i <= 5; i++ {
+		s2.Sent(data(i))
+		s2.Received(data(i))
+	}
+	require.Empty(s2.Unacked())
+	require.Equal(uint64(0), s2.ReceivedCount())
+}
@@ -0,0 +1,90 @@
+package tls
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vicxqh/srp/log"
+)
+
+// revocationList rejects certificates revoked by a CRL file. The file is loaded again whenever it is
+// modified, so that revoking a certificate does not require a restart.
+type revocationList struct {
+	file string
+	cas  []*x509.Certificate // one of them must have signed the list
+
+	mu         sync.Mutex
+	modTime    time.Time
+	issuer     string
+	nextUpdate time.Time
+	revoked    map[string]bool // serial numbers
+}
+
+func (r *revocationList) load() error {
+	info, err := os.Stat(r.file)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s, %v", r.file, err)
+	}
+	if info.ModTime().Equal(r.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(r.file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s, %v", r.file, err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseCRL(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse revocation list %s, %v", r.file, err)
+	}
+	var issuer *x509.Certificate
+	for _, ca := range r.cas {
+		if ca.CheckCRLSignature(crl) == nil {
+			issuer = ca
+			break
+		}
+	}
+	if issuer == nil {
+		return fmt.Errorf("revocation list %s is not signed by any trusted CA", r.file)
+	}
+	if crl.HasExpired(time.Now()) {
+		return fmt.Errorf("revocation list %s has expired at %v", r.file, crl.TBSCertList.NextUpdate)
+	}
+	revoked := make(map[string]bool, len(crl.TBSCertList.RevokedCertificates))
+	for _, entry := range crl.TBSCertList.RevokedCertificates {
+		revoked[entry.SerialNumber.String()] = true
+	}
+	r.modTime = info.ModTime()
+	r.issuer = string(issuer.RawSubject)
+	r.nextUpdate = crl.TBSCertList.NextUpdate
+	r.revoked = revoked
+	return nil
+}
+
+// verify is a tls.Config.VerifyPeerCertificate, it is called after the chains are verified against the CAs.
+// It fails closed once the list in use has expired, a list that can not be refreshed is not trusted forever.
+func (r *revocationList) verify(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.load(); err != nil {
+		log.Error("failed to reload revocation list, %v", err)
+	}
+	if !r.nextUpdate.IsZero() && time.Now().After(r.nextUpdate) {
+		return fmt.Errorf("revocation list %s has expired at %v", r.file, r.nextUpdate)
+	}
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if string(cert.RawIssuer) == r.issuer && r.revoked[cert.SerialNumber.String()] {
+				return fmt.Errorf("certificate %s(serial %s) is revoked", cert.Subject.CommonName, cert.SerialNumber)
+			}
+		}
+	}
+	return nil
+}
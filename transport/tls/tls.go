@@ -0,0 +1,161 @@
+package tls
+
+import (
+	gotls "crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/vicxqh/srp/transport/plain"
+)
+
+// Connection carries segments the same way plain.Connection does, but inside a TLS session.
+type Connection struct {
+	*plain.Connection
+	conn *gotls.Conn
+}
+
+// Server wraps the server side of conn in TLS.
+func Server(conn net.Conn, config *gotls.Config) *Connection {
+	tc := gotls.Server(conn, config)
+	return &Connection{plain.NewConnection(tc), tc}
+}
+
+// Client wraps the client side of conn in TLS.
+func Client(conn net.Conn, config *gotls.Config) *Connection {
+	tc := gotls.Client(conn, config)
+	return &Connection{plain.NewConnection(tc), tc}
+}
+
+// Handshake runs the TLS handshake. It is run by the first read or write if not called explicitly.
+func (c *Connection) Handshake() error {
+	return c.conn.Handshake()
+}
+
+func (c *Connection) ConnectionState() gotls.ConnectionState {
+	return c.conn.ConnectionState()
+}
+
+// VerifyPeerName checks that the verified certificate of the peer is issued to name, either as its common
+// name or as one of its DNS names.
+func (c *Connection) VerifyPeerName(name string) error {
+	state := c.conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return errors.New("peer presented no verified certificate")
+	}
+	cert := state.VerifiedChains[0][0]
+	if cert.Subject.CommonName == name {
+		return nil
+	}
+	for _, dnsName := range cert.DNSNames {
+		if dnsName == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate of %s is not issued to %s", cert.Subject.CommonName, name)
+}
+
+// ServerConfig loads the certificate presented to agents.
+func ServerConfig(certFile, keyFile string) (*gotls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both certificate and key are required")
+	}
+	cert, err := gotls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key pair %s, %s, %v", certFile, keyFile, err)
+	}
+	return &gotls.Config{
+		Certificates: []gotls.Certificate{cert},
+		MinVersion:   gotls.VersionTLS12,
+	}, nil
+}
+
+// RequireClientCert makes config require a client certificate signed by a CA in caFile, which must not be
+// revoked by the revocation list in crlFile, if crlFile is not empty.
+func RequireClientCert(config *gotls.Config, caFile, crlFile string) error {
+	cas, err := loadCerts(caFile)
+	if err != nil {
+		return err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	for _, ca := range cas {
+		config.ClientCAs.AddCert(ca)
+	}
+	config.ClientAuth = gotls.RequireAndVerifyClientCert
+	if crlFile != "" {
+		crl := &revocationList{file: crlFile, cas: cas}
+		if err := crl.load(); err != nil {
+			return err
+		}
+		config.VerifyPeerCertificate = crl.verify
+	}
+	return nil
+}
+
+// ClientConfig creates a config verifying that the server presents a certificate for serverName, signed by
+// a CA in caFile, or by a system CA if caFile is empty. The key pair in certFile and keyFile, if any, is
+// presented to servers asking for a client certificate.
+func ClientConfig(caFile, serverName, certFile, keyFile string) (*gotls.Config, error) {
+	config := &gotls.Config{
+		ServerName: serverName,
+		MinVersion: gotls.VersionTLS12,
+	}
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := gotls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key pair %s, %s, %v", certFile, keyFile, err)
+		}
+		config.Certificates = []gotls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// LoadCertPool loads PEM encoded certificates in file.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	certs, err := loadCerts(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+func loadCerts(file string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s, %v", file, err)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate in %s, %v", file, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return certs, nil
+}
@@ -0,0 +1,276 @@
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	gotls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vicxqh/srp/proto"
+	"github.com/vicxqh/srp/transport"
+)
+
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+// issue creates a certificate for cn, with dnsNames as SAN, for server and client auth.
+func (ca *testCA) issue(t *testing.T, cn string, dnsNames ...string) (gotls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	ca.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return gotls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func (ca *testCA) writeCert(t *testing.T, dir string) string {
+	file := filepath.Join(dir, "ca.crt")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	require.Nil(t, ioutil.WriteFile(file, data, 0600))
+	return file
+}
+
+func (ca *testCA) writeCRL(t *testing.T, file string, expiry time.Time, revoked ...*x509.Certificate) {
+	var entries []pkix.RevokedCertificate
+	for _, cert := range revoked {
+		entries = append(entries, pkix.RevokedCertificate{SerialNumber: cert.SerialNumber, RevocationTime: time.Now()})
+	}
+	der, err := ca.cert.CreateCRL(rand.Reader, ca.key, entries, time.Now().Add(-time.Minute), expiry)
+	require.Nil(t, err)
+	data := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+	require.Nil(t, ioutil.WriteFile(file, data, 0600))
+	// make sure the modification is noticed
+	modTime := time.Now().Add(time.Duration(len(revoked)) * time.Second)
+	require.Nil(t, os.Chtimes(file, modTime, modTime))
+}
+
+// handshake connects a server and a client over loopback, and returns their handshake errors. Unlike a
+// net.Pipe, loopback buffers the alert of a server rejecting a client that has finished its handshake.
+func handshake(t *testing.T, serverConfig, clientConfig *gotls.Config) (*Connection, *Connection, error, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	cconn, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	sconn, err := l.Accept()
+	require.Nil(t, err)
+	server := Server(sconn, serverConfig)
+	client := Client(cconn, clientConfig)
+	serverErr := make(chan error, 1)
+	go func() {
+		err := server.Handshake()
+		if err != nil {
+			sconn.Close()
+		}
+		serverErr <- err
+	}()
+	clientErr := client.Handshake()
+	if clientErr != nil {
+		cconn.Close()
+	}
+	return server, client, <-serverErr, clientErr
+}
+
+func TestMutualTLS(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "srp-tls")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "test-ca")
+	caFile := ca.writeCert(t, dir)
+	serverCert, _ := ca.issue(t, "server", "srp.example.com")
+	byCN, _ := ca.issue(t, "agent-a")
+	bySAN, _ := ca.issue(t, "some-host", "agent-b")
+	revoked, revokedCert := ca.issue(t, "agent-c")
+	crlFile := filepath.Join(dir, "ca.crl")
+	ca.writeCRL(t, crlFile, time.Now().Add(time.Hour))
+
+	serverConfig := &gotls.Config{Certificates: []gotls.Certificate{serverCert}}
+	require.Nil(RequireClientCert(serverConfig, caFile, crlFile))
+	clientConfig := func(cert gotls.Certificate) *gotls.Config {
+		return &gotls.Config{
+			RootCAs:      serverConfig.ClientCAs,
+			ServerName:   "srp.example.com",
+			Certificates: []gotls.Certificate{cert},
+		}
+	}
+
+	// name in CN
+	server, _, serr, cerr := handshake(t, serverConfig, clientConfig(byCN))
+	require.Nil(serr)
+	require.Nil(cerr)
+	require.Nil(server.VerifyPeerName("agent-a"))
+	require.NotNil(server.VerifyPeerName("agent-b"))
+
+	// name in SAN
+	server, _, serr, cerr = handshake(t, serverConfig, clientConfig(bySAN))
+	require.Nil(serr)
+	require.Nil(cerr)
+	require.Nil(server.VerifyPeerName("agent-b"))
+	require.NotNil(server.VerifyPeerName("agent-a"))
+
+	// no client certificate
+	_, _, serr, _ = handshake(t, serverConfig, &gotls.Config{RootCAs: serverConfig.ClientCAs, ServerName: "srp.example.com"})
+	require.NotNil(serr)
+
+	// certificate of another CA
+	other, _ := newTestCA(t, "other-ca").issue(t, "agent-a")
+	_, _, serr, _ = handshake(t, serverConfig, clientConfig(other))
+	require.NotNil(serr)
+
+	// revoked after the server started, the list is reloaded
+	_, _, serr, _ = handshake(t, serverConfig, clientConfig(revoked))
+	require.Nil(serr)
+	ca.writeCRL(t, crlFile, time.Now().Add(time.Hour), revokedCert)
+	_, _, serr, _ = handshake(t, serverConfig, clientConfig(revoked))
+	require.NotNil(serr)
+	_, _, serr, _ = handshake(t, serverConfig, clientConfig(byCN))
+	require.Nil(serr)
+}
+
+func TestRevocationListRejected(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "srp-tls")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "test-ca")
+	caFile := ca.writeCert(t, dir)
+
+	// expired list
+	crlFile := filepath.Join(dir, "expired.crl")
+	ca.writeCRL(t, crlFile, time.Now().Add(-time.Second))
+	require.NotNil(RequireClientCert(&gotls.Config{}, caFile, crlFile))
+
+	// list signed by another CA
+	crlFile = filepath.Join(dir, "other.crl")
+	newTestCA(t, "other-ca").writeCRL(t, crlFile, time.Now().Add(time.Hour))
+	require.NotNil(RequireClientCert(&gotls.Config{}, caFile, crlFile))
+}
+
+func TestRoundTrip(t *testing.T) {
+	require := require.New(t)
+
+	ca := newTestCA(t, "test-ca")
+	serverCert, _ := ca.issue(t, "server", "srp.example.com")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	serverConfig := &gotls.Config{Certificates: []gotls.Certificate{serverCert}}
+
+	sconn, cconn := net.Pipe()
+	server := Server(sconn, serverConfig)
+	client := Client(cconn, &gotls.Config{RootCAs: roots, ServerName: "srp.example.com"})
+	defer sconn.Close()
+	defer cconn.Close()
+
+	header := proto.NewHeader(proto.TypeData, 42)
+	header.SetPayloadLength(5)
+	sent := make(chan error, 1)
+	go func() {
+		// the handshake is run by the first write
+		sent <- client.Send(transport.Segment{Header: header, Payload: []byte("hello")})
+	}()
+	seg, err := server.Receive()
+	require.Nil(err)
+	require.Nil(<-sent)
+	require.Equal(proto.TypeData, seg.Header.Type())
+	require.Equal(uint32(42), seg.Header.Stream())
+	require.Equal("hello", string(seg.Payload))
+	require.True(client.ConnectionState().HandshakeComplete)
+
+	go func() {
+		sent <- server.Send(transport.NewWindowUpdate(42, 1024))
+	}()
+	seg, err = client.Receive()
+	require.Nil(err)
+	require.Nil(<-sent)
+	increment, err := transport.WindowIncrement(seg)
+	require.Nil(err)
+	require.Equal(uint32(1024), increment)
+}
+
+func TestServerVerification(t *testing.T) {
+	require := require.New(t)
+
+	ca := newTestCA(t, "test-ca")
+	serverCert, _ := ca.issue(t, "server", "srp.example.com")
+	serverConfig := &gotls.Config{Certificates: []gotls.Certificate{serverCert}}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(newTestCA(t, "other-ca").cert)
+
+	pipe := func(clientConfig *gotls.Config) (error, error) {
+		sconn, cconn := net.Pipe()
+		server := Server(sconn, serverConfig)
+		client := Client(cconn, clientConfig)
+		serverErr := make(chan error, 1)
+		go func() {
+			err := server.Handshake()
+			sconn.Close()
+			serverErr <- err
+		}()
+		err := client.Handshake()
+		cconn.Close()
+		return err, <-serverErr
+	}
+
+	cerr, serr := pipe(&gotls.Config{RootCAs: roots, ServerName: "srp.example.com"})
+	require.Nil(cerr)
+	require.Nil(serr)
+
+	// wrong server name
+	cerr, serr = pipe(&gotls.Config{RootCAs: roots, ServerName: "evil.example.com"})
+	require.NotNil(cerr)
+	require.NotNil(serr)
+
+	// untrusted CA
+	cerr, serr = pipe(&gotls.Config{RootCAs: otherRoots, ServerName: "srp.example.com"})
+	require.NotNil(cerr)
+	require.NotNil(serr)
+}
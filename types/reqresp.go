@@ -1,8 +1,50 @@
 package types
 
-type AgentRegistrationRequest Agent
+type AgentRegistrationRequest struct {
+	Agent
+	// Token authenticates the agent, it is required if the server issued a token for Agent.ID
+	Token string `json:",omitempty"`
+	// Version is the highest protocol version the agent speaks
+	Version int
+	// Capabilities are the optional features the agent supports
+	Capabilities []string `json:",omitempty"`
+	// Session is the session to resume, Received is how many of its segments the agent has received
+	Session  string `json:",omitempty"`
+	Received uint64 `json:",omitempty"`
+	// Pool is the pool of links to join, it is empty for the first link of the agent. A link that only
+	// Joins is rejected if the pool is gone, rather than registering the agent again.
+	Pool string `json:",omitempty"`
+	Join bool   `json:",omitempty"`
+	// Services are the services that the agent offers, Addr is dialed by the agent
+	Services []Service `json:",omitempty"`
+}
 
 type AgentRegistrationResponse struct {
 	Succeeded bool
 	Message   string
+	// Permanent tells that the agent is rejected for a reason that retrying does not fix
+	Permanent bool `json:",omitempty"`
+	// Version is the protocol version used on the link
+	Version int
+	// Capabilities are the optional features both sides support, they are used on the link
+	Capabilities []string `json:",omitempty"`
+	// AgentID is the ID that the agent is registered as, it differs from the requested one if another agent
+	// of that ID is connected
+	AgentID string `json:",omitempty"`
+	// Session identifies the session of the link, it is empty if the server does not resume sessions
+	Session string `json:",omitempty"`
+	// Resumed tells that the requested session is resumed, Received is how many of its segments the
+	// server has received
+	Resumed  bool   `json:",omitempty"`
+	Received uint64 `json:",omitempty"`
+	// Pool identifies the pool of links of the agent, more links join it by presenting it. It is empty if
+	// the server does not pool links.
+	Pool string `json:",omitempty"`
+}
+
+// AgentToken is the response of issuing a token for an agent. The token is shown only once, the server
+// keeps nothing but its hash.
+type AgentToken struct {
+	AgentID string
+	Token   string
 }
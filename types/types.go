@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 // Agent represents a agent connection that is used for forwarding data between a user and a server.
 type Agent struct {
 	ID          string // unique
@@ -11,7 +13,55 @@ type Service struct {
 	ID          string // unique
 	Addr        string
 	Description string
-	ExposedBy   string // Agent.ID
+	ExposedBy   string // Agent.ID, IDs of a pool of agents are separated by commas
+	Balance     string // how users are spread over the pool of agents
+	Bind        string // address or interface of ServerPort, all interfaces if empty
 	ServerPort  string // which server port exposes this service
+	Hostname    string // requests for this host on the http front end are routed to the service
+	TLS         bool   // users connect with TLS, which the server terminates with Certificate
+	Network     string // tcp or udp, of ServerPort
+	IdleTimeout string // how long a user of a udp service may stay silent before it is forgotten
 	//Enabled     bool   // access to users enabled?
+
+	// Certificate is presented to users of the service if the server terminates TLS for them
+	Certificate *Certificate `json:",omitempty"`
+	// ProxyProtocol is ProxyProtocolV1 or ProxyProtocolV2 to tell the service about users by a PROXY protocol
+	// header on each of its tcp connections, the service is not told if empty
+	ProxyProtocol string `json:",omitempty"`
+}
+
+// versions of the PROXY protocol
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// CertificateSourceAPI is the source of certificates uploaded through the api.
+const CertificateSourceAPI = "api"
+
+// Certificate is what a server presents to users of a service when it terminates TLS for them.
+type Certificate struct {
+	Cert     string    `json:",omitempty"` // PEM chain, only given on upload
+	Key      string    `json:",omitempty"` // PEM private key, only given on upload
+	Source   string    // CertificateSourceAPI, or the file it is loaded from
+	DNSNames []string  // names the certificate is issued to
+	NotAfter time.Time // when it expires
+}
+
+// Role is what an api key is allowed to do.
+type Role string
+
+const (
+	// RoleRead allows GET requests only
+	RoleRead Role = "read"
+	// RoleAdmin allows every request
+	RoleAdmin Role = "admin"
+)
+
+// APIKey authenticates requests to the management api.
+type APIKey struct {
+	Name    string // unique
+	Role    Role
+	Key     string `json:",omitempty"` // only returned on creation
+	Created time.Time
 }
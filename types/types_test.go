@@ -11,7 +11,6 @@ func TestJson(t *testing.T) {
 		ID:          "test-service-a",
 		Addr:        "192.168.1.2:1900",
 		Description: "test description",
-		Enabled:     false,
 	}
 	data, _ := json.Marshal(&s)
 	fmt.Println(string(data))